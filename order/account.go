@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// Account holds what a participant of an Exchange has traded.
+type Account struct {
+	// Positions holds the number of units held of each symbol, which is
+	// negative for short positions.
+	Positions map[string]int64
+	// Cash is the money received for sales minus the money paid for
+	// purchases, as a number of ticks.
+	Cash Price
+}
+
+// account returns the Account called name, creating it if needed.
+func (ex *Exchange) account(name string) *Account {
+	acct, ok := ex.accounts[name]
+	if !ok {
+		acct = &Account{Positions: map[string]int64{}}
+		ex.accounts[name] = acct
+	}
+	return acct
+}
+
+// settle updates the accounts of the orders of m for the trade.
+func (ex *Exchange) settle(m *Match) {
+	for _, order := range []*Order{m.Taker, m.Maker} {
+		if order.Account == "" {
+			continue
+		}
+		acct := ex.account(order.Account)
+		units := int64(m.Volume)
+		if order.Side == SellSide {
+			units = -units
+		}
+		acct.Positions[order.Symbol] += units
+		acct.Cash -= Price(units) * m.Price
+	}
+}
+
+// writePositions writes the position in each symbol and the cash of
+// each account to w, ordered by account and symbol, as lines like
+// "position alice 10 AAPL" and "cash alice -995.00".
+//
+// As for matches, the symbol is left out for the default instrument.
+func (ex *Exchange) writePositions(w io.Writer) {
+	for _, name := range sortedKeys(ex.accounts) {
+		acct := ex.accounts[name]
+		for _, symbol := range sortedKeys(acct.Positions) {
+			fmt.Fprintln(w, withSymbol(fmt.Sprintf("position %s %d", name, acct.Positions[symbol]), symbol))
+		}
+		fmt.Fprintf(w, "cash %s %v\n", name, acct.Cash)
+	}
+}
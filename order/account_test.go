@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestOrderBook_SelfTrade(t *testing.T) {
+	in := []string{
+		"limit sell 5 99.00 acct=alice",
+		"limit sell 5 99.50 acct=bob",
+		"limit buy 8 99.50 acct=alice",
+	}
+	cases := []struct {
+		stp         SelfTradePolicy
+		want        []string
+		wantResting []OrderNumber
+	}{
+		{AllowSelfTrade, []string{"match 3 1 5 99.00", "match 3 2 3 99.50"}, []OrderNumber{2}},
+		{CancelNewest, []string{}, []OrderNumber{1, 2}},
+		{CancelOldest, []string{"match 3 2 5 99.50"}, []OrderNumber{3}},
+		{DecrementBoth, []string{"match 3 2 3 99.50"}, []OrderNumber{2}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.stp.String(), func(t *testing.T) {
+			book := newOrderBook()
+			book.stp = tc.stp
+			got := addAll(&book, in...)
+			if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+				t.Errorf("got %q; want %q", got, tc.want)
+			}
+			for _, id := range tc.wantResting {
+				if book.orders[id] == nil {
+					t.Errorf("got order %v not resting; want it resting", id)
+				}
+			}
+			if len(book.orders) != len(tc.wantResting) {
+				t.Errorf("got %d resting orders; want %v", len(book.orders), tc.wantResting)
+			}
+		})
+	}
+}
+
+func TestOrderBook_SelfTradeFillOrKill(t *testing.T) {
+	in := []string{
+		"limit sell 5 99.00 acct=bob",
+		"limit sell 5 99.00 acct=alice",
+		"limit buy 10 99.00 fok acct=alice",
+	}
+	cases := []struct {
+		stp  SelfTradePolicy
+		want []string
+	}{
+		{AllowSelfTrade, []string{"match 3 1 5 99.00", "match 3 2 5 99.00"}},
+		// Only bob's 5 units could trade, so nothing does.
+		{CancelNewest, []string{"reject 3 fill-or-kill order can't be filled"}},
+		{CancelOldest, []string{"reject 3 fill-or-kill order can't be filled"}},
+		{DecrementBoth, []string{"reject 3 fill-or-kill order can't be filled"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.stp.String(), func(t *testing.T) {
+			book := newOrderBook()
+			book.stp = tc.stp
+			got := addAll(&book, in...)
+			if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+				t.Errorf("got %q; want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExchange_positions(t *testing.T) {
+	ex := newExchange()
+	in := strings.Join([]string{
+		"limit sell 5 99.00 acct=alice",
+		"limit buy 3 100.00 acct=bob",
+		"limit buy 2 99.00 sym=AAPL acct=bob",
+		"market sell 2 0.00 sym=AAPL",
+	}, "\n")
+	w := &bytes.Buffer{}
+	if err := run(ex, strings.NewReader(in), w, &bytes.Buffer{}, true); err != nil {
+		t.Fatalf("run() got error %v", err)
+	}
+	ex.writePositions(w)
+	if got, want := ex.accounts["bob"].Positions["AAPL"], int64(2); got != want {
+		t.Errorf("got bob AAPL position %d; want %d", got, want)
+	}
+	if got, want := ex.accounts["alice"].Cash, Price(29700); got != want {
+		t.Errorf("got alice cash %v; want %v", got, want)
+	}
+	want := strings.Join([]string{
+		"match 2 1 3 99.00",
+		"match 4 3 2 99.00 AAPL",
+		"position alice -3",
+		"cash alice 297.00",
+		"position bob 3",
+		"position bob 2 AAPL",
+		"cash bob -495.00",
+		"",
+	}, "\n")
+	if got := w.String(); got != want {
+		t.Errorf("got output %q; want %q", got, want)
+	}
+}
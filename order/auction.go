@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// auctionLevel is the volume at one price of a side of the book.
+type auctionLevel struct {
+	price  Price
+	volume Volume
+}
+
+// sideVolumes returns the volume at each level of s, in ascending price
+// order. Iceberg orders take part in auctions with all their units.
+func sideVolumes(s *bookSide) []auctionLevel {
+	levels := []auctionLevel{}
+	s.levels.ascend(func(level *priceLevel) bool {
+		levels = append(levels, auctionLevel{level.price, level.total()})
+		return true
+	})
+	return levels
+}
+
+// Indicative returns the price that the book would uncross at now, the
+// volume that would execute and the imbalance between the buy and sell
+// volume willing to trade at that price, which is positive if there is
+// more to buy.
+//
+// The price is the one that maximises the executed volume. Ties are
+// broken by the smallest imbalance, then by proximity to the last trade
+// in the book, and then by the lowest price. The volume is 0 if the book
+// is not crossed.
+func (book *OrderBook) Indicative() (price Price, volume Volume, imbalance int64) {
+	buys, sells := sideVolumes(book.buyOrders), sideVolumes(book.sellOrders)
+	prices := []Price{}
+	for _, l := range append(append([]auctionLevel{}, buys...), sells...) {
+		prices = append(prices, l.price)
+	}
+	sort.Slice(prices, func(i, j int) bool { return prices[i] < prices[j] })
+
+	// demand is the volume to buy at or above prices[i], which starts
+	// with all buy volume and drops as i increases.
+	demand := Volume(0)
+	for _, l := range buys {
+		demand += l.volume
+	}
+	supply := Volume(0)
+	b, s := 0, 0
+	found := false
+	for i, p := range prices {
+		if i > 0 && p == prices[i-1] {
+			continue
+		}
+		for ; b < len(buys) && buys[b].price < p; b++ {
+			demand -= buys[b].volume
+		}
+		for ; s < len(sells) && sells[s].price <= p; s++ {
+			supply += sells[s].volume
+		}
+		executed := demand
+		if supply < executed {
+			executed = supply
+		}
+		if executed == 0 {
+			continue
+		}
+		imb := int64(demand) - int64(supply)
+		if !found || book.betterUncross(p, executed, imb, price, volume, imbalance) {
+			price, volume, imbalance = p, executed, imb
+			found = true
+		}
+	}
+	return price, volume, imbalance
+}
+
+// betterUncross returns true if uncrossing at price p, executing volume
+// with imbalance imb, is better than at the current best choice.
+func (book *OrderBook) betterUncross(p Price, volume Volume, imb int64, bestPrice Price, bestVolume Volume, bestImb int64) bool {
+	if volume != bestVolume {
+		return volume > bestVolume
+	}
+	abs := func(n int64) int64 {
+		if n < 0 {
+			return -n
+		}
+		return n
+	}
+	if abs(imb) != abs(bestImb) {
+		return abs(imb) < abs(bestImb)
+	}
+	if book.last != 0 {
+		return abs(int64(p-book.last)) < abs(int64(bestPrice-book.last))
+	}
+	// Prices are tried in ascending order, so the lowest one is kept.
+	return false
+}
+
+// uncross executes all crossing orders in the book at the single price
+// given by Indicative, and ends the auction.
+//
+// Since there is no aggressor in an auction, the newer order of each
+// match is its Taker.
+func (book *OrderBook) uncross() Matches {
+	book.auction = false
+	price, volume, _ := book.Indicative()
+	matches := Matches{}
+	for volume > 0 {
+		buy, sell := book.buyOrders.best().front(), book.sellOrders.best().front()
+		match := &Match{Taker: buy, Maker: sell, Volume: volume, Price: price}
+		if buy.id < sell.id {
+			match.Taker, match.Maker = sell, buy
+		}
+		for _, o := range []*Order{buy, sell} {
+			if o.Remaining < match.Volume {
+				match.Volume = o.Remaining
+			}
+		}
+		match.execute()
+		book.closed(buy, match.Volume)
+		book.closed(sell, match.Volume)
+		book.last = price
+		debug("Executed %q\n", match)
+		if book.events != nil {
+			book.events(match.Output())
+		}
+		matches = append(matches, match)
+		for _, o := range []*Order{buy, sell} {
+			if o.executed {
+				book.remove(book.side(o.Side), o)
+			} else {
+				book.requeue(o)
+			}
+		}
+		volume -= match.Volume
+	}
+	return matches
+}
+
+// StartAuction puts the book for symbol in auction mode, where orders
+// rest without matching until the book is uncrossed.
+func (ex *Exchange) StartAuction(symbol string) {
+	if ex.events != nil {
+		ex.events(commandLine("auction", symbol))
+	}
+	ex.book(symbol).auction = true
+}
+
+// Uncross executes the crossing orders in the book for symbol at a single
+// price, and ends its auction.
+//
+// The matches are returned, followed by the matches for any stop orders
+// that they triggered.
+func (ex *Exchange) Uncross(symbol string) Matches {
+	if ex.events != nil {
+		ex.events(commandLine("uncross", symbol))
+	}
+	book := ex.book(symbol)
+	return ex.finish(book, 0, book.uncross())
+}
+
+// writeIndicative writes the indicative uncrossing price, volume and
+// imbalance of the book to w, as a line like "indicative 99.50 15 -5",
+// with "-" as the price if the book is not crossed.
+//
+// The Symbol of the book is appended, unless it is the default
+// instrument.
+func (book *OrderBook) writeIndicative(w io.Writer) {
+	price, volume, imbalance := book.Indicative()
+	p := "-"
+	if volume > 0 {
+		p = price.String()
+	}
+	fmt.Fprintln(w, withSymbol(fmt.Sprintf("indicative %s %v %v", p, volume, imbalance), book.symbol))
+}
+
+// commandLine returns the command name for symbol, in the format
+// accepted by runCommand.
+func commandLine(name, symbol string) string {
+	if symbol == "" {
+		return name
+	}
+	return name + " sym=" + symbol
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestOrderBook_Indicative(t *testing.T) {
+	cases := []struct {
+		desc          string
+		last          Price
+		in            []string
+		wantPrice     Price
+		wantVolume    Volume
+		wantImbalance int64
+	}{
+		{
+			desc:       "not crossed",
+			in:         []string{"limit buy 5 99.00", "limit sell 5 100.00"},
+			wantVolume: 0,
+		},
+		{
+			desc:       "max volume",
+			in:         []string{"limit buy 5 101.00", "limit buy 5 100.00", "limit sell 8 99.00", "limit sell 2 100.50"},
+			wantPrice:  9900,
+			wantVolume: 8, wantImbalance: 2,
+		},
+		{
+			desc:       "min imbalance",
+			in:         []string{"limit buy 4 100.00", "limit sell 2 98.00", "limit sell 2 99.00", "limit sell 5 99.50"},
+			wantPrice:  9900,
+			wantVolume: 4,
+		},
+		{
+			desc:       "lowest price",
+			in:         []string{"limit buy 5 101.00", "limit sell 5 99.00"},
+			wantPrice:  9900,
+			wantVolume: 5,
+		},
+		{
+			desc:       "reference price",
+			last:       10050,
+			in:         []string{"limit buy 5 101.00", "limit sell 5 99.00"},
+			wantPrice:  10100,
+			wantVolume: 5,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			book := newOrderBook()
+			book.auction = true
+			book.last = tc.last
+			addAll(&book, tc.in...)
+			price, volume, imbalance := book.Indicative()
+			if volume != tc.wantVolume || (volume > 0 && price != tc.wantPrice) || imbalance != tc.wantImbalance {
+				t.Errorf("got %v, %v, %v; want %v, %v, %v", price, volume, imbalance, tc.wantPrice, tc.wantVolume, tc.wantImbalance)
+			}
+		})
+	}
+}
+
+func TestRun_auction(t *testing.T) {
+	in := strings.Join([]string{
+		"indicative",
+		"auction",
+		"limit buy 5 100.00",
+		"limit sell 3 99.00",
+		"indicative",
+		"limit sell 4 99.50",
+		"indicative",
+		"uncross",
+		"indicative",
+		"uncross sym=AAPL",
+		"auction 1",
+	}, "\n")
+	w, errw := &bytes.Buffer{}, &bytes.Buffer{}
+	if err := run(newExchange(), strings.NewReader(in), w, errw, false); err != nil {
+		t.Fatalf("run() got error %v", err)
+	}
+	want := strings.Join([]string{
+		"indicative 99.00 3 2",
+		"indicative 99.50 5 -2",
+		"match 2 1 3 99.50",
+		"match 3 1 2 99.50",
+		"indicative - 0 0",
+		"",
+	}, "\n")
+	if got := w.String(); got != want {
+		t.Errorf("got output (-want +got):\n%s", diffLines(got, want))
+	}
+	if !strings.Contains(errw.String(), "line 11: ") {
+		t.Errorf("got errors %q; want line 11 to be rejected", errw)
+	}
+}
+
+func TestOrderBook_uncrossIceberg(t *testing.T) {
+	book := newOrderBook()
+	book.auction = true
+	addAll(&book, "limit sell 10 99.00 peak=4", "limit sell 2 99.00", "limit buy 4 100.00")
+	book.uncross()
+	iceberg := book.orders[1]
+	if iceberg.Remaining != 6 || iceberg.Displayed() != 4 {
+		t.Errorf("got %v remaining and %v displayed; want 6 and 4", iceberg.Remaining, iceberg.Displayed())
+	}
+	// The replenished part of the iceberg order goes behind order 2.
+	if got := book.sellOrders.best().front().id; got != 2 {
+		t.Errorf("got order %v first in queue; want 2", got)
+	}
+}
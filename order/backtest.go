@@ -0,0 +1,541 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// Strategy is a trading strategy run against historical order flow by
+	// a Backtest.
+	//
+	// A Strategy acts through its Broker, which is passed to each call.
+	// Orders that it submits reach the Exchange after the latency of the
+	// Backtest, so the market may have moved by then.
+	Strategy interface {
+		// OnMarketData is called with each event of the market data feed
+		// of the Exchange: trades, best bid and offer changes and bars.
+		OnMarketData(b *Broker, event MarketEvent)
+		// OnFill is called each time an order of the Strategy executes.
+		OnFill(b *Broker, fill Fill)
+	}
+
+	// Fill is the execution of part of an Order.
+	Fill struct {
+		Order  *Order
+		Volume Volume
+		Price  Price
+	}
+
+	// Broker is the link of a Strategy to the Exchange of a Backtest.
+	//
+	// The orders of the Strategy trade for the Account named after it.
+	Broker struct {
+		bt       *Backtest
+		name     string
+		strategy Strategy
+		// pending is the number of orders and cancels of the Strategy
+		// that have not reached the Exchange yet.
+		pending int
+		// fills is the number of times orders of the Strategy executed,
+		// and volume the units they executed in total.
+		fills  int
+		volume Volume
+		// rejects is the number of orders of the Strategy that the
+		// Exchange rejected.
+		rejects int
+		// slippage is the money lost to fills at worse prices than the
+		// market when the orders were submitted.
+		slippage Price
+		// refs holds the reference price of each order of the Strategy
+		// for slippage, or 0 if the market had no price then.
+		refs map[*Order]Price
+	}
+
+	// action is an order or cancel from a Strategy on its way to the
+	// Exchange.
+	action struct {
+		// at is when the action reaches the Exchange, in nanoseconds
+		// since the Unix epoch.
+		at    int64
+		from  *Broker
+		order *Order
+		// cancel is the order to cancel, for cancels.
+		cancel *Order
+	}
+
+	// Backtest replays historical orders to an Exchange, along with the
+	// orders of its strategies.
+	Backtest struct {
+		ex *Exchange
+		// latency is how long orders from strategies take to reach the
+		// Exchange.
+		latency time.Duration
+		// now is the current time, in nanoseconds since the Unix epoch.
+		now int64
+		// brokers holds the Broker of each Strategy, by name.
+		brokers map[string]*Broker
+		// owners holds the Broker of each order from a Strategy that may
+		// still execute.
+		owners map[*Order]*Broker
+		// arrived holds the orders from strategies that have reached the
+		// Exchange and may still execute, by number.
+		arrived map[OrderNumber]*Order
+		// touched holds the orders cancelled or triggered in the books
+		// by the order being added.
+		touched []OrderNumber
+		// pending holds the actions of strategies not yet at the
+		// Exchange, by arrival time. Since the latency is the same for
+		// all actions, they arrive in the order they were taken.
+		pending []action
+		// quotes holds the last Quote of each symbol.
+		quotes map[string]Quote
+	}
+)
+
+// strategies holds a constructor for each built-in Strategy, by name.
+var strategies = map[string]func() Strategy{
+	"momentum": func() Strategy { return &Momentum{Volume: 1} },
+	"maker":    func() Strategy { return &Maker{Volume: 1} },
+}
+
+// NewBacktest returns a Backtest running strategies, by name, against
+// ex, where their orders take latency to arrive.
+//
+// The market data of ex goes to the strategies, building bars of
+// interval seconds, or no bars if interval is 0.
+func NewBacktest(ex *Exchange, latency time.Duration, interval int64, strategies map[string]Strategy) *Backtest {
+	bt := &Backtest{
+		ex:      ex,
+		latency: latency,
+		brokers: map[string]*Broker{},
+		owners:  map[*Order]*Broker{},
+		arrived: map[OrderNumber]*Order{},
+		quotes:  map[string]Quote{},
+	}
+	for name, strategy := range strategies {
+		bt.brokers[name] = &Broker{bt: bt, name: name, strategy: strategy, refs: map[*Order]Price{}}
+	}
+	ex.marketData = NewMarketData(interval, bt.onMarketData)
+	events := ex.events
+	ex.events = func(event string) {
+		if events != nil {
+			events(event)
+		}
+		name, id, _ := strings.Cut(event, " ")
+		if n, err := strconv.ParseInt(id, 10, 64); err == nil && (name == "cancelled" || name == "triggered") {
+			bt.touched = append(bt.touched, OrderNumber(n))
+		}
+	}
+	return bt
+}
+
+// onMarketData passes event to each Strategy, ordered by name.
+func (bt *Backtest) onMarketData(event MarketEvent) {
+	if q, ok := event.(Quote); ok {
+		bt.quotes[q.Symbol] = q
+	}
+	for _, name := range sortedKeys(bt.brokers) {
+		b := bt.brokers[name]
+		b.strategy.OnMarketData(b, event)
+	}
+}
+
+// Run adds the orders read by next to the Exchange at their Time, with
+// the orders of the strategies in between, until next returns io.EOF.
+//
+// Orders without a Time happen at the time of the previous order. Once
+// all orders are read, the remaining actions of the strategies are
+// carried out, and any open bars are closed.
+func (bt *Backtest) Run(next func() (*Order, error)) error {
+	for n := 1; ; n++ {
+		order, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("record %d: %w", n, err)
+		}
+		t := order.Time * int64(time.Second)
+		if t < bt.now {
+			t = bt.now
+		}
+		if err := bt.deliver(t); err != nil {
+			return err
+		}
+		bt.advance(t)
+		if err := bt.add(order, nil); err != nil {
+			return fmt.Errorf("record %d: %w", n, err)
+		}
+	}
+	if err := bt.deliver(math.MaxInt64); err != nil {
+		return err
+	}
+	bt.ex.marketData.Close()
+	return nil
+}
+
+// deliver carries out the actions of strategies that arrive by t,
+// including those taken in response to them.
+func (bt *Backtest) deliver(t int64) error {
+	for len(bt.pending) > 0 && bt.pending[0].at <= t {
+		a := bt.pending[0]
+		bt.pending = bt.pending[1:]
+		a.from.pending--
+		bt.advance(a.at)
+		order := a.order
+		if a.cancel != nil {
+			if bt.ex.bookOf(a.cancel.id) == nil {
+				// The order executed, expired or was never added.
+				continue
+			}
+			order = newOrder(fmt.Sprintf("cancel na %v 0.00", a.cancel.id))
+		}
+		order.Time = bt.now / int64(time.Second)
+		if err := bt.add(order, a.from); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// advance moves the clock of the Backtest to t, expiring orders in the
+// Exchange.
+func (bt *Backtest) advance(t int64) {
+	bt.now = t
+	for _, order := range bt.ex.Expire(t / int64(time.Second)) {
+		bt.forget(order)
+	}
+}
+
+// add adds order to the Exchange, from the Strategy of b, or from the
+// historical orders if b is nil, and reports the fills of orders of
+// strategies.
+func (bt *Backtest) add(order *Order, b *Broker) error {
+	matches, err := bt.ex.Add(order)
+	if _, ok := err.(*Reject); ok {
+		if b != nil {
+			b.rejects++
+		}
+	} else if err != nil {
+		return err
+	}
+	if b != nil && order.Type != Cancel {
+		bt.arrived[order.id] = order
+	}
+	for _, m := range matches {
+		for _, o := range []*Order{m.Taker, m.Maker} {
+			if owner, ok := bt.owners[o]; ok {
+				owner.fill(Fill{o, m.Volume, m.Price})
+			}
+		}
+	}
+	for _, m := range matches {
+		bt.forget(m.Taker)
+		bt.forget(m.Maker)
+	}
+	bt.forget(order)
+	for _, id := range bt.touched {
+		if o, ok := bt.arrived[id]; ok {
+			bt.forget(o)
+		}
+	}
+	bt.touched = nil
+	return nil
+}
+
+// forget drops the order of a Strategy that reached the Exchange once it
+// no longer rests in the books.
+func (bt *Backtest) forget(order *Order) {
+	if order.level != nil {
+		return
+	}
+	if b, ok := bt.owners[order]; ok {
+		delete(b.refs, order)
+		delete(bt.owners, order)
+	}
+	delete(bt.arrived, order.id)
+}
+
+// fill records fill of an order of the Strategy, and reports it.
+func (b *Broker) fill(fill Fill) {
+	b.fills++
+	b.volume += fill.Volume
+	if ref := b.refs[fill.Order]; ref != 0 {
+		diff := fill.Price - ref
+		if fill.Order.Side == SellSide {
+			diff = -diff
+		}
+		b.slippage += Price(fill.Volume) * diff
+	}
+	b.strategy.OnFill(b, fill)
+}
+
+// Now returns the current time of the Backtest, in nanoseconds since the
+// Unix epoch.
+func (b *Broker) Now() int64 {
+	return b.bt.now
+}
+
+// Quote returns the last best bid and offer for symbol.
+func (b *Broker) Quote(symbol string) Quote {
+	return b.bt.quotes[symbol]
+}
+
+// Position returns the number of units of symbol that the Strategy
+// holds, which is negative for short positions.
+func (b *Broker) Position(symbol string) int64 {
+	if acct, ok := b.bt.ex.accounts[b.name]; ok {
+		return acct.Positions[symbol]
+	}
+	return 0
+}
+
+// Pending returns the number of orders and cancels of the Strategy that
+// have not reached the Exchange yet.
+func (b *Broker) Pending() int {
+	return b.pending
+}
+
+// Submit sends the order given in the format of ParseOrder to the
+// Exchange, and returns it. Its number is set once it arrives.
+//
+// Cancel and Modify orders can't be submitted; use Cancel instead.
+func (b *Broker) Submit(orderstr string) (*Order, error) {
+	order, err := ParseOrder(orderstr)
+	if err != nil {
+		return nil, err
+	}
+	if order.Type == Cancel || order.Type == Modify {
+		return nil, fmt.Errorf("can't submit %v orders", order.Type)
+	}
+	order.Account = b.name
+	b.refs[order] = b.reference(order.Symbol)
+	b.bt.owners[order] = b
+	b.send(action{order: order})
+	return order, nil
+}
+
+// Cancel sends a cancel for order, which was submitted by the Strategy.
+// It has no effect if the order is no longer open when the cancel
+// arrives.
+func (b *Broker) Cancel(order *Order) {
+	b.send(action{cancel: order})
+}
+
+// send schedules a to reach the Exchange after the latency.
+func (b *Broker) send(a action) {
+	a.at = b.bt.now + int64(b.bt.latency)
+	a.from = b
+	b.pending++
+	b.bt.pending = append(b.bt.pending, a)
+}
+
+// reference returns the price that orders for symbol are expected to
+// trade at now: the middle of the best bid and offer, or the last trade
+// if a side is empty, or 0 if there is neither.
+func (b *Broker) reference(symbol string) Price {
+	q := b.bt.quotes[symbol]
+	if q.BidVolume > 0 && q.AskVolume > 0 {
+		return (q.Bid + q.Ask) / 2
+	}
+	if book, ok := b.bt.ex.books[symbol]; ok {
+		return book.last
+	}
+	return 0
+}
+
+// pnl returns the profit or loss of the Strategy, marking its positions
+// at the last trade of each symbol.
+func (b *Broker) pnl() Price {
+	acct, ok := b.bt.ex.accounts[b.name]
+	if !ok {
+		return 0
+	}
+	pnl := acct.Cash
+	for symbol, units := range acct.Positions {
+		pnl += Price(units) * b.bt.ex.books[symbol].last
+	}
+	return pnl
+}
+
+// WriteReport writes the results of each Strategy to w, ordered by name,
+// as lines like
+//
+//	strategy maker fills 3 volume 5 rejects 0 pnl 1.50 slippage -0.50
+//
+// followed by the position of the Strategy in each symbol, as for
+// writePositions. Slippage is the money lost to fills at worse prices
+// than the middle of the best bid and offer when the orders were
+// submitted, and is negative for fills at better prices.
+func (bt *Backtest) WriteReport(w io.Writer) {
+	for _, name := range sortedKeys(bt.brokers) {
+		b := bt.brokers[name]
+		fmt.Fprintf(w, "strategy %s fills %d volume %v rejects %d pnl %v slippage %v\n", name, b.fills, b.volume, b.rejects, b.pnl(), b.slippage)
+		if acct, ok := bt.ex.accounts[name]; ok {
+			for _, symbol := range sortedKeys(acct.Positions) {
+				fmt.Fprintln(w, withSymbol(fmt.Sprintf("position %s %d", name, acct.Positions[symbol]), symbol))
+			}
+		}
+	}
+}
+
+// recordOrder returns the Order described by the fields of a historical
+// record, which are named:
+//
+//	time     the Time of the order, in seconds since the Unix epoch
+//	type     the OrderType, e.g. "limit"
+//	side     the OrderSide, e.g. "buy"
+//	volume   the number of units
+//	price    the limit, or threshold of Stop orders
+//	stop     the threshold of StopLimit orders
+//	id       the order to cancel or modify
+//	sym      the symbol, if not the default instrument
+//	acct     the account
+//	options  other options in the format of ParseOrder, e.g. "ioc post"
+//
+// Empty fields are left out.
+func recordOrder(rec map[string]string) (*Order, error) {
+	var values []string
+	switch rec["type"] {
+	case "cancel":
+		values = []string{"cancel", "na", rec["id"], "0"}
+	case "modify":
+		values = []string{"modify", "na", rec["id"], rec["price"], rec["volume"]}
+	case "stoplimit":
+		values = []string{"stoplimit", rec["side"], rec["volume"], rec["stop"], rec["price"]}
+	default:
+		values = []string{rec["type"], rec["side"], rec["volume"], rec["price"]}
+	}
+	line := strings.Join(values, " ")
+	for _, key := range []string{"sym", "acct", "time"} {
+		if rec[key] != "" {
+			line += " " + key + "=" + rec[key]
+		}
+	}
+	if rec["options"] != "" {
+		line += " " + rec["options"]
+	}
+	return ParseOrder(line)
+}
+
+// csvOrders returns a func reading the orders in the CSV in r, whose
+// first row names the fields described for recordOrder.
+func csvOrders(r io.Reader) func() (*Order, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	var header []string
+	return func() (*Order, error) {
+		if header == nil {
+			var err error
+			if header, err = cr.Read(); err != nil {
+				return nil, err
+			}
+		}
+		row, err := cr.Read()
+		if err != nil {
+			return nil, err
+		}
+		rec := map[string]string{}
+		for i, key := range header {
+			rec[key] = row[i]
+		}
+		return recordOrder(rec)
+	}
+}
+
+// jsonOrders returns a func reading the orders in the JSON lines in r,
+// which are objects with the fields described for recordOrder, e.g.
+//
+//	{"time": 1700000000, "type": "limit", "side": "buy", "volume": 10, "price": "99.00"}
+//
+// Prices may be given as strings or numbers.
+func jsonOrders(r io.Reader) func() (*Order, error) {
+	scanner := bufio.NewScanner(r)
+	return func() (*Order, error) {
+		for scanner.Scan() {
+			if strings.TrimSpace(scanner.Text()) == "" {
+				continue
+			}
+			fields := map[string]json.RawMessage{}
+			if err := json.Unmarshal(scanner.Bytes(), &fields); err != nil {
+				return nil, err
+			}
+			rec := map[string]string{}
+			for key, raw := range fields {
+				var s string
+				if err := json.Unmarshal(raw, &s); err != nil {
+					s = string(raw)
+				}
+				rec[key] = s
+			}
+			return recordOrder(rec)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+}
+
+// historicalOrders returns a func reading the orders in r, which is CSV
+// if path ends in ".csv" and JSON lines if it ends in ".jsonl".
+func historicalOrders(path string, r io.Reader) (func() (*Order, error), error) {
+	switch filepath.Ext(path) {
+	case ".csv":
+		return csvOrders(r), nil
+	case ".jsonl":
+		return jsonOrders(r), nil
+	}
+	return nil, fmt.Errorf("unknown format of %s: want .csv or .jsonl", path)
+}
+
+// parseStrategies returns the built-in strategies listed in s, separated
+// by commas, by name.
+func parseStrategies(s string) (map[string]Strategy, error) {
+	result := map[string]Strategy{}
+	for _, name := range strings.Split(s, ",") {
+		newStrategy, ok := strategies[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown strategy %q: want one of %s", name, strings.Join(sortedKeys(strategies), ", "))
+		}
+		result[name] = newStrategy()
+	}
+	return result, nil
+}
+
+// backtest runs the -strategies against ex with the historical orders
+// at path, and writes their results to stdout.
+func backtest(ex *Exchange, path string) error {
+	strategies, err := parseStrategies(*strategyNames)
+	if err != nil {
+		return err
+	}
+	if *barInterval < 0 || *barInterval%time.Second != 0 {
+		return fmt.Errorf("invalid bar interval %v: must be whole seconds", *barInterval)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	next, err := historicalOrders(path, f)
+	if err != nil {
+		return err
+	}
+	bt := NewBacktest(ex, *latency, int64(*barInterval/time.Second), strategies)
+	if err := bt.Run(next); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	bt.WriteReport(os.Stdout)
+	return nil
+}
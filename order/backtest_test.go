@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scripted is a Strategy submitting the next of its orders on each
+// Quote with an offer, and recording its fills.
+type scripted struct {
+	orders []string
+	fills  []string
+}
+
+func (s *scripted) OnMarketData(b *Broker, event MarketEvent) {
+	if q, ok := event.(Quote); !ok || q.AskVolume == 0 || len(s.orders) == 0 {
+		return
+	}
+	if _, err := b.Submit(s.orders[0]); err != nil {
+		panic(err)
+	}
+	s.orders = s.orders[1:]
+}
+
+func (s *scripted) OnFill(b *Broker, fill Fill) {
+	s.fills = append(s.fills, fmt.Sprintf("%v %v %v at %v", fill.Order.id, fill.Volume, fill.Price, b.Now()/int64(time.Second)))
+}
+
+// orderList returns a func reading the orders in lines, as for
+// Backtest.Run.
+func orderList(lines ...string) func() (*Order, error) {
+	return func() (*Order, error) {
+		if len(lines) == 0 {
+			return nil, io.EOF
+		}
+		order, err := ParseOrder(lines[0])
+		lines = lines[1:]
+		return order, err
+	}
+}
+
+func TestBacktest(t *testing.T) {
+	cases := []struct {
+		latency   time.Duration
+		wantFills []string
+		want      string
+	}{
+		{
+			// The order arrives before the offer at 101, and pays a
+			// point over the middle of 98.00 and 100.00.
+			latency:   0,
+			wantFills: []string{"3 2 100.00 at 100"},
+			want:      "strategy s fills 1 volume 2 rejects 0 pnl -2.00 slippage 2.00\nposition s 2\n",
+		},
+		{
+			// The order arrives after the better offer at 101.
+			latency:   2 * time.Second,
+			wantFills: []string{"5 5 99.00 at 102"},
+			want:      "strategy s fills 1 volume 5 rejects 0 pnl 5.00 slippage 0.00\nposition s 5\n",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.latency.String(), func(t *testing.T) {
+			s := &scripted{orders: []string{"market buy 5 0.00"}}
+			bt := NewBacktest(newExchange(), tc.latency, 0, map[string]Strategy{"s": s})
+			err := bt.Run(orderList(
+				"limit buy 1 98.00 time=100",
+				"limit sell 2 100.00 time=100",
+				"limit sell 3 100.50 time=101",
+				"limit sell 5 99.00 time=101",
+				"market buy 1 0.00 time=103",
+			))
+			if err != nil {
+				t.Fatalf("Run() got error %v", err)
+			}
+			if got, want := strings.Join(s.fills, "\n"), strings.Join(tc.wantFills, "\n"); got != want {
+				t.Errorf("got fills (-want +got):\n%s", diffLines(got, want))
+			}
+			w := &bytes.Buffer{}
+			bt.WriteReport(w)
+			if got := w.String(); got != tc.want {
+				t.Errorf("got report (-want +got):\n%s", diffLines(got, tc.want))
+			}
+		})
+	}
+}
+
+func TestBacktest_forget(t *testing.T) {
+	s := &scripted{orders: []string{
+		"limit sell 1 110.00 gtt=105",
+		"market buy 1 0.00",
+		"limit buy 1 90.00",
+		"limit sell 1 99.00",
+		"limit buy 1 99.00",
+	}}
+	ex := newExchange()
+	ex.stp = CancelOldest
+	bt := NewBacktest(ex, 0, 0, map[string]Strategy{"s": s})
+	err := bt.Run(orderList(
+		"limit sell 2 100.00 time=100",
+		"limit sell 1 99.90 time=101",
+		"limit sell 1 99.80 time=102",
+		"limit sell 1 99.70 time=103",
+		"limit sell 1 99.60 time=104",
+		"limit sell 1 99.50 time=110",
+	))
+	if err != nil {
+		t.Fatalf("Run() got error %v", err)
+	}
+	if len(s.orders) != 0 {
+		t.Fatalf("got %d orders not submitted", len(s.orders))
+	}
+	// Only the buys are still resting: the order at 110.00 expired, the
+	// market order executed, and self-trade prevention cancelled the
+	// sell at 99.00.
+	resting := []string{}
+	for o := range bt.owners {
+		resting = append(resting, o.Line())
+		if bt.arrived[o.id] != o || o.level == nil {
+			t.Errorf("got order %v of the strategy not resting", o.id)
+		}
+	}
+	sort.Strings(resting)
+	if want := []string{"limit buy 1 90.00 acct=s time=101", "limit buy 1 99.00 acct=s time=101"}; strings.Join(resting, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got owned orders %q; want %q", resting, want)
+	}
+	if len(bt.arrived) != len(bt.owners) || len(bt.brokers["s"].refs) != len(bt.owners) {
+		t.Errorf("got %d arrived orders and %d refs; want %d", len(bt.arrived), len(bt.brokers["s"].refs), len(bt.owners))
+	}
+}
+
+func TestHistoricalOrders(t *testing.T) {
+	csv := strings.Join([]string{
+		"time,type,side,volume,price,stop,id,sym,options",
+		"100,limit,buy,10,99.00,,,AAPL,post",
+		"101,stoplimit,sell,5,98.00,98.50,,,",
+		"102,modify,,10,99.50,,1,,",
+		",cancel,,,,,1,,",
+	}, "\n")
+	jsonl := strings.Join([]string{
+		`{"time": 100, "type": "limit", "side": "buy", "volume": 10, "price": "99.00", "sym": "AAPL", "options": "post"}`,
+		`{"time": 101, "type": "stoplimit", "side": "sell", "volume": 5, "price": 98.00, "stop": "98.50"}`,
+		``,
+		`{"time": 102, "type": "modify", "volume": 10, "price": "99.50", "id": 1}`,
+		`{"type": "cancel", "id": 1}`,
+	}, "\n")
+	want := []string{
+		"limit buy 10 99.00 sym=AAPL post time=100",
+		"stoplimit sell 5 98.50 98.00 time=101",
+		"modify na 1 99.50 10 time=102",
+		"cancel na 1 0",
+	}
+	for _, tc := range []struct{ path, in string }{{"orders.csv", csv}, {"orders.jsonl", jsonl}} {
+		next, err := historicalOrders(tc.path, strings.NewReader(tc.in))
+		if err != nil {
+			t.Fatalf("historicalOrders(%q) got error %v", tc.path, err)
+		}
+		got := []string{}
+		for {
+			order, err := next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: got error %v", tc.path, err)
+			}
+			got = append(got, order.Line())
+		}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("%s: got orders (-want +got):\n%s", tc.path, diffLines(strings.Join(got, "\n"), strings.Join(want, "\n")))
+		}
+	}
+	if _, err := historicalOrders("orders.txt", strings.NewReader("")); err == nil {
+		t.Errorf("historicalOrders(%q) got no error", "orders.txt")
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import "container/list"
+
+type (
+	// priceLevel holds the resting orders at a single price, in time
+	// priority (oldest first).
+	priceLevel struct {
+		price  Price
+		orders list.List
+	}
+
+	// levelNode is a node in a levelTree.
+	levelNode struct {
+		level       *priceLevel
+		left, right *levelNode
+		height      int
+	}
+
+	// levelTree is a balanced (AVL) binary search tree of price levels,
+	// using the price of each level as comparison key.
+	levelTree struct {
+		root *levelNode
+		len  int
+	}
+
+	// bookSide holds the resting orders for one side of the book, grouped
+	// by price level.
+	bookSide struct {
+		// side is the side of the orders held, or UndefinedSide if orders
+		// from both sides may be held.
+		side   OrderSide
+		levels levelTree
+	}
+)
+
+// front returns the oldest Order at the level.
+func (l *priceLevel) front() *Order {
+	e := l.orders.Front()
+	if e == nil {
+		return nil
+	}
+	return e.Value.(*Order)
+}
+
+// each calls fn for each Order at the level, oldest first, until fn
+// returns false.
+func (l *priceLevel) each(fn func(*Order) bool) bool {
+	for e := l.orders.Front(); e != nil; {
+		// fn may remove the order, so advance first.
+		next := e.Next()
+		if !fn(e.Value.(*Order)) {
+			return false
+		}
+		e = next
+	}
+	return true
+}
+
+// volume returns the number of units displayed by all orders at the
+// level, which leaves out the hidden units of iceberg orders.
+func (l *priceLevel) volume() Volume {
+	total := Volume(0)
+	l.each(func(order *Order) bool {
+		total += order.Displayed()
+		return true
+	})
+	return total
+}
+
+// total returns the number of units remaining in all orders at the
+// level, including the hidden units of iceberg orders.
+func (l *priceLevel) total() Volume {
+	total := Volume(0)
+	l.each(func(order *Order) bool {
+		total += order.Remaining
+		return true
+	})
+	return total
+}
+
+func (n *levelNode) getHeight() int {
+	if n == nil {
+		return 0
+	}
+	return n.height
+}
+
+func (n *levelNode) update() {
+	n.height = n.left.getHeight() + 1
+	if h := n.right.getHeight() + 1; h > n.height {
+		n.height = h
+	}
+}
+
+func (n *levelNode) balance() int {
+	return n.left.getHeight() - n.right.getHeight()
+}
+
+func (n *levelNode) rotateLeft() *levelNode {
+	r := n.right
+	n.right = r.left
+	r.left = n
+	n.update()
+	r.update()
+	return r
+}
+
+func (n *levelNode) rotateRight() *levelNode {
+	l := n.left
+	n.left = l.right
+	l.right = n
+	n.update()
+	l.update()
+	return l
+}
+
+// rebalance restores the AVL property at n and returns the new root of
+// the subtree.
+func (n *levelNode) rebalance() *levelNode {
+	n.update()
+	switch b := n.balance(); {
+	case b > 1:
+		if n.left.balance() < 0 {
+			n.left = n.left.rotateLeft()
+		}
+		return n.rotateRight()
+	case b < -1:
+		if n.right.balance() > 0 {
+			n.right = n.right.rotateRight()
+		}
+		return n.rotateLeft()
+	}
+	return n
+}
+
+// removeMin drops the lowest node of the subtree and returns its new root.
+func (n *levelNode) removeMin() *levelNode {
+	if n.left == nil {
+		return n.right
+	}
+	n.left = n.left.removeMin()
+	return n.rebalance()
+}
+
+// get returns the level with price p, or nil if there is none.
+func (t *levelTree) get(p Price) *priceLevel {
+	n := t.root
+	for n != nil {
+		if p < n.level.price {
+			n = n.left
+		} else if p > n.level.price {
+			n = n.right
+		} else {
+			return n.level
+		}
+	}
+	return nil
+}
+
+// insert returns the level with price p, adding an empty one if needed.
+func (t *levelTree) insert(p Price) *priceLevel {
+	var level *priceLevel
+	var ins func(n *levelNode) *levelNode
+	ins = func(n *levelNode) *levelNode {
+		if n == nil {
+			level = &priceLevel{price: p}
+			t.len++
+			return &levelNode{level: level, height: 1}
+		}
+		if p < n.level.price {
+			n.left = ins(n.left)
+		} else if p > n.level.price {
+			n.right = ins(n.right)
+		} else {
+			level = n.level
+			return n
+		}
+		return n.rebalance()
+	}
+	t.root = ins(t.root)
+	return level
+}
+
+// remove drops the level with price p, if any.
+func (t *levelTree) remove(p Price) {
+	var del func(n *levelNode) *levelNode
+	del = func(n *levelNode) *levelNode {
+		if n == nil {
+			return nil
+		}
+		if p < n.level.price {
+			n.left = del(n.left)
+		} else if p > n.level.price {
+			n.right = del(n.right)
+		} else {
+			t.len--
+			if n.left == nil {
+				return n.right
+			}
+			if n.right == nil {
+				return n.left
+			}
+			// Replace n with its in-order successor.
+			succ := n.right
+			for succ.left != nil {
+				succ = succ.left
+			}
+			n.level = succ.level
+			n.right = n.right.removeMin()
+		}
+		return n.rebalance()
+	}
+	t.root = del(t.root)
+}
+
+// min returns the level with the lowest price, or nil if t is empty.
+func (t *levelTree) min() *priceLevel {
+	n := t.root
+	if n == nil {
+		return nil
+	}
+	for n.left != nil {
+		n = n.left
+	}
+	return n.level
+}
+
+// max returns the level with the highest price, or nil if t is empty.
+func (t *levelTree) max() *priceLevel {
+	n := t.root
+	if n == nil {
+		return nil
+	}
+	for n.right != nil {
+		n = n.right
+	}
+	return n.level
+}
+
+// ascend calls fn for each level in ascending price order until fn
+// returns false.
+func (t *levelTree) ascend(fn func(*priceLevel) bool) {
+	var walk func(n *levelNode) bool
+	walk = func(n *levelNode) bool {
+		if n == nil {
+			return true
+		}
+		return walk(n.left) && fn(n.level) && walk(n.right)
+	}
+	walk(t.root)
+}
+
+// descend calls fn for each level in descending price order until fn
+// returns false.
+func (t *levelTree) descend(fn func(*priceLevel) bool) {
+	var walk func(n *levelNode) bool
+	walk = func(n *levelNode) bool {
+		if n == nil {
+			return true
+		}
+		return walk(n.right) && fn(n.level) && walk(n.left)
+	}
+	walk(t.root)
+}
+
+// newBookSide returns an empty bookSide for orders on side.
+func newBookSide(side OrderSide) *bookSide {
+	return &bookSide{side: side}
+}
+
+// best returns the level with the best price for the side, i.e. the
+// highest bid or the lowest ask, or nil if the side is empty.
+func (s *bookSide) best() *priceLevel {
+	if s.side == BuySide {
+		return s.levels.max()
+	}
+	return s.levels.min()
+}
+
+// each calls fn for each level from best to worst price until fn returns
+// false.
+func (s *bookSide) each(fn func(*priceLevel) bool) {
+	if s.side == BuySide {
+		s.levels.descend(fn)
+	} else {
+		s.levels.ascend(fn)
+	}
+}
+
+// add appends order to the back of the queue at its resting price.
+func (s *bookSide) add(order *Order) {
+	level := s.levels.insert(order.restingPrice())
+	order.level = level
+	order.elem = level.orders.PushBack(order)
+}
+
+// remove takes order out of its queue, dropping the level if it becomes
+// empty.
+func (s *bookSide) remove(order *Order) {
+	level := order.level
+	if level == nil {
+		return
+	}
+	level.orders.Remove(order.elem)
+	if level.orders.Len() == 0 {
+		s.levels.remove(level.price)
+	}
+	order.level = nil
+	order.elem = nil
+}
+
+// crossedBy returns true if order would match the best level of the side.
+func (s *bookSide) crossedBy(order *Order) bool {
+	level := s.best()
+	return level != nil && order.crosses(level.price)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLevelTree(t *testing.T) {
+	tree := levelTree{}
+	// A sorted feed degenerated the old orderTree into a linked list.
+	for i := 1; i <= 1000; i++ {
+		tree.insert(Price(i))
+	}
+	if tree.len != 1000 {
+		t.Errorf("got len %d; want 1000", tree.len)
+	}
+	if h := tree.root.getHeight(); h > 15 {
+		t.Errorf("got height %d for 1000 levels; want <= 15", h)
+	}
+
+	for i := 2; i <= 1000; i += 2 {
+		tree.remove(Price(i))
+	}
+	tree.remove(Price(2000))
+	if tree.len != 500 {
+		t.Errorf("got len %d after remove; want 500", tree.len)
+	}
+	want := Price(1)
+	tree.ascend(func(level *priceLevel) bool {
+		if level.price != want {
+			t.Errorf("got level %v; want %v", level.price, want)
+		}
+		want += 2
+		return true
+	})
+	if got := tree.min().price; got != 1 {
+		t.Errorf("got min %v; want 1", got)
+	}
+	if got := tree.max().price; got != 999 {
+		t.Errorf("got max %v; want 999", got)
+	}
+	if tree.get(2) != nil {
+		t.Errorf("got level for removed price 2")
+	}
+}
+
+func TestBookSide(t *testing.T) {
+	cases := []struct {
+		side OrderSide
+		want []OrderNumber
+	}{
+		{BuySide, []OrderNumber{2, 4, 1, 3}},
+		{SellSide, []OrderNumber{1, 3, 2, 4}},
+	}
+	for _, tc := range cases {
+		t.Run(fmt.Sprintf("%v", tc.side), func(t *testing.T) {
+			s := newBookSide(tc.side)
+			orders := []*Order{
+				{id: 1, Side: tc.side, Limit: 99},
+				{id: 2, Side: tc.side, Limit: 100},
+				{id: 3, Side: tc.side, Limit: 99},
+				{id: 4, Side: tc.side, Limit: 100},
+				{id: 5, Side: tc.side, Limit: 98},
+			}
+			for _, o := range orders {
+				s.add(o)
+			}
+			s.remove(orders[4])
+			got := []OrderNumber{}
+			s.each(func(level *priceLevel) bool {
+				return level.each(func(o *Order) bool {
+					got = append(got, o.id)
+					return true
+				})
+			})
+			if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+				t.Errorf("got order %v; want %v", got, tc.want)
+			}
+			if s.levels.len != 2 {
+				t.Errorf("got %d levels; want 2", s.levels.len)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import "fmt"
+
+// Exchange holds one OrderBook per symbol.
+//
+// Orders are numbered across all books of the Exchange.
+type Exchange struct {
+	// books holds the OrderBook for each symbol, which is created when
+	// the first order for the symbol is added.
+	books map[string]*OrderBook
+	// resting holds the OrderBook that each resting order is in, by
+	// number. It is shared with the books, which keep it up to date.
+	resting   map[OrderNumber]*OrderBook
+	nextOrder OrderNumber
+	// events, if set, is called with a description of each Order added
+	// to the Exchange, such as "order limit buy 10 99.00", or auction
+	// command, such as "uncross", followed by the changes it caused in
+	// the books.
+	events func(event string)
+	// accounts holds the Account of each participant that has traded.
+	accounts map[string]*Account
+	// policies holds the MatchingPolicy of the book for each symbol that
+	// doesn't use FIFO.
+	policies map[string]MatchingPolicy
+	// stp is the SelfTradePolicy of the books.
+	stp SelfTradePolicy
+	// risk holds the checks that orders must pass before they are added
+	// to a book.
+	risk []RiskCheck
+	// marketData, if set, is updated with each Order added to the
+	// Exchange.
+	marketData *MarketData
+	// now is the latest time seen by the Exchange, in seconds since the
+	// Unix epoch, from the Time of orders or calls to Expire.
+	now int64
+}
+
+// newExchange returns a new Exchange with no books.
+func newExchange() *Exchange {
+	return &Exchange{
+		books:     map[string]*OrderBook{},
+		resting:   map[OrderNumber]*OrderBook{},
+		accounts:  map[string]*Account{},
+		policies:  map[string]MatchingPolicy{},
+		nextOrder: 1,
+	}
+}
+
+// book returns the OrderBook for symbol, creating it if needed.
+func (ex *Exchange) book(symbol string) *OrderBook {
+	book, ok := ex.books[symbol]
+	if !ok {
+		b := newOrderBook()
+		b.symbol = symbol
+		b.stp = ex.stp
+		if policy, ok := ex.policies[symbol]; ok {
+			b.policy = policy
+		}
+		b.nextOrder = &ex.nextOrder
+		b.resting = ex.resting
+		b.events = func(event string) {
+			if ex.events != nil {
+				ex.events(event)
+			}
+		}
+		book = &b
+		ex.books[symbol] = book
+	}
+	return book
+}
+
+// bookOf returns the OrderBook where order id is resting, or nil if
+// there is none.
+func (ex *Exchange) bookOf(id OrderNumber) *OrderBook {
+	return ex.resting[id]
+}
+
+// Symbols returns the symbols that the Exchange has books for, in order.
+func (ex *Exchange) Symbols() []string {
+	return sortedKeys(ex.books)
+}
+
+// Add adds and attempts to execute an Order in the book for its Symbol.
+//
+// Cancel and Modify orders go to the book of the order they refer to,
+// regardless of their Symbol. If it isn't resting in any book, Cancel
+// orders do nothing and Modify orders are rejected.
+//
+// Orders that fail the risk checks of the Exchange, or whose Expiry has
+// already passed, are rejected before they reach the book. Expire should
+// be called with the Time of the Order first, so that it can't match
+// orders that have expired.
+//
+// The matches for the Order are returned, followed by the matches for
+// any stop orders that they triggered.
+func (ex *Exchange) Add(order *Order) (Matches, error) {
+	var book *OrderBook
+	switch order.Type {
+	case Cancel:
+		book = ex.bookOf(order.ToCancel)
+	case Modify:
+		book = ex.bookOf(order.ToModify)
+	default:
+		book = ex.book(order.Symbol)
+	}
+	if ex.events != nil {
+		ex.events("order " + order.Line())
+	}
+	ex.setExpiry(order)
+	if order.Time > ex.now {
+		ex.now = order.Time
+	}
+	var matches Matches
+	var err error
+	var reason string
+	if book == nil {
+		if order.Type == Modify {
+			reason = fmt.Sprintf("no open order %v to modify", order.ToModify)
+		}
+	} else {
+		reason = ex.check(book, order)
+	}
+	if reason == "" && order.Expiry > 0 && order.Expiry <= ex.now {
+		reason = fmt.Sprintf("expired at %v", order.Expiry)
+	}
+	if reason != "" {
+		order.id = ex.nextOrder
+		ex.nextOrder++
+		err = &Reject{order, reason}
+	} else if book == nil {
+		order.id = ex.nextOrder
+		ex.nextOrder++
+		debug("No resting order %v to cancel\n", order.ToCancel)
+	} else {
+		matches, err = book.Add(order)
+	}
+	if r, ok := err.(*Reject); ok && ex.events != nil {
+		ex.events(r.Output())
+	}
+	if book == nil {
+		return nil, err
+	}
+	return ex.finish(book, order.Time, matches), err
+}
+
+// finish executes the stop orders in book triggered by matches, and
+// updates the accounts and market data for all of the resulting matches,
+// which happened at time t.
+//
+// The matches are returned, followed by the matches for the triggered
+// stop orders.
+func (ex *Exchange) finish(book *OrderBook, t int64, matches Matches) Matches {
+	matches = append(matches, book.getTriggeredStops(matches)...)
+	for _, m := range matches {
+		ex.settle(m)
+	}
+	if ex.marketData != nil {
+		ex.marketData.update(book, t, matches)
+	}
+	return matches
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExchange(t *testing.T) {
+	ex := newExchange()
+	lines := []string{
+		"limit buy 10 99.00 sym=AAPL",
+		"limit sell 10 101.00 sym=MSFT",
+		"stop sell 5 98.00 sym=AAPL",
+		"limit buy 5 98.00 sym=AAPL",
+		"limit buy 5 100.00",
+		"limit sell 12 98.00 sym=AAPL",
+		"cancel na 2 0.00",
+		"modify na 5 97.00 5 sym=MSFT",
+	}
+	got := []string{}
+	for _, line := range lines {
+		matches, err := ex.Add(newOrder(line))
+		if err != nil {
+			t.Fatalf("Add(%q) got error %v", line, err)
+		}
+		for _, m := range matches {
+			got = append(got, m.Output())
+		}
+	}
+	want := []string{
+		"match 6 1 10 99.00 AAPL",
+		"match 6 4 2 98.00 AAPL",
+		"match 3 4 3 98.00 AAPL",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	if got, want := strings.Join(ex.Symbols(), ","), ",AAPL,MSFT"; got != want {
+		t.Errorf("got symbols %q; want %q", got, want)
+	}
+	if book := ex.bookOf(2); book != nil {
+		t.Errorf("got book %q for cancelled order 2; want none", book.symbol)
+	}
+	if book := ex.bookOf(5); book == nil || book.symbol != "" || book.orders[5].Limit != 9700 {
+		t.Errorf("got book %v for modified order 5; want default book", book)
+	}
+	if _, ok := ex.books["MSFT"].orders[2]; ok {
+		t.Errorf("got order 2 resting in MSFT after cancel")
+	}
+	for _, symbol := range ex.Symbols() {
+		for id := range ex.books[symbol].orders {
+			if book := ex.bookOf(id); book != ex.books[symbol] {
+				t.Errorf("got book %v for order %v; want %q", book, id, symbol)
+			}
+		}
+	}
+	if got, want := len(ex.resting), 1; got != want {
+		t.Errorf("got %d resting orders; want %d", got, want)
+	}
+}
+
+func TestExchange_unknownTarget(t *testing.T) {
+	ex := newExchange()
+	cases := []struct {
+		in   string
+		want string
+	}{
+		// Cancelling an order that isn't resting does nothing.
+		{"cancel na 7 0.00 sym=AAPL", ""},
+		{"modify na 7 99.00 5 sym=MSFT", "reject 2 no open order 7 to modify"},
+	}
+	for _, tc := range cases {
+		matches, err := ex.Add(newOrder(tc.in))
+		if tc.want == "" {
+			if matches != nil || err != nil {
+				t.Errorf("Add(%q) got %v, error %v; want nothing", tc.in, matches, err)
+			}
+			continue
+		}
+		if r, ok := err.(*Reject); !ok || r.Output() != tc.want {
+			t.Errorf("Add(%q) got error %v; want %q", tc.in, err, tc.want)
+		}
+	}
+	if symbols := ex.Symbols(); len(symbols) != 0 {
+		t.Errorf("got books %q; want none", symbols)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// secondsPerDay is the length of the trading day of GoodForDay orders,
+// which ends at midnight UTC.
+const secondsPerDay = 24 * 60 * 60
+
+// expiryQueue is a min-heap of orders by Expiry, and then by number.
+//
+// Each order is queued once, when it first rests. Orders stay in the
+// queue after they stop resting, and are skipped when they reach the
+// front.
+type expiryQueue []*Order
+
+func (q expiryQueue) Len() int { return len(q) }
+
+func (q expiryQueue) Less(i, j int) bool {
+	if q[i].Expiry != q[j].Expiry {
+		return q[i].Expiry < q[j].Expiry
+	}
+	return q[i].id < q[j].id
+}
+
+func (q expiryQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *expiryQueue) Push(x interface{}) { *q = append(*q, x.(*Order)) }
+
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	order := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return order
+}
+
+// setExpiry sets the Expiry of a GoodForDay order to the end of the day
+// of its Time, or of the current time of the Exchange if it has none.
+// Orders without a time stay in the book until cancelled.
+func (ex *Exchange) setExpiry(order *Order) {
+	if order.TimeInForce != GoodForDay {
+		return
+	}
+	t := order.Time
+	if ex.now > t {
+		t = ex.now
+	}
+	if t > 0 {
+		order.Expiry = (t/secondsPerDay + 1) * secondsPerDay
+	}
+}
+
+// due returns the orders resting in the book that expire at or before t,
+// and takes them out of the queue.
+func (book *OrderBook) due(t int64) []*Order {
+	orders := []*Order{}
+	for book.expiries.Len() > 0 && book.expiries[0].Expiry <= t {
+		order := heap.Pop(&book.expiries).(*Order)
+		if book.orders[order.id] == order {
+			orders = append(orders, order)
+		}
+	}
+	return orders
+}
+
+// expire removes the resting order from the book once its time in force
+// has run out, and marks it as cancelled.
+func (book *OrderBook) expire(order *Order) {
+	book.remove(book.holder(order), order)
+	order.cancelled = true
+	debug("Expired %v\n", order)
+	book.emit("expire %v", order.id)
+}
+
+// Expire advances the time of the Exchange to t, in seconds since the
+// Unix epoch, and removes the resting orders that expire by then.
+//
+// The expired orders are returned in the order they expired, by Expiry
+// and then by number. The time of the Exchange never goes back, so
+// Expire does nothing if t is before it.
+func (ex *Exchange) Expire(t int64) []*Order {
+	if t <= ex.now {
+		return nil
+	}
+	ex.now = t
+	expired := []*Order{}
+	for _, symbol := range ex.Symbols() {
+		expired = append(expired, ex.books[symbol].due(t)...)
+	}
+	sort.SliceStable(expired, func(i, j int) bool {
+		return expiryQueue(expired).Less(i, j)
+	})
+	for _, order := range expired {
+		book := ex.books[order.Symbol]
+		book.expire(order)
+		if ex.marketData != nil {
+			ex.marketData.update(book, t, nil)
+		}
+	}
+	return expired
+}
+
+// expireOrder removes the resting order with number id as Expire would,
+// and returns it, or nil if there is no such order.
+func (ex *Exchange) expireOrder(id OrderNumber) *Order {
+	book := ex.bookOf(id)
+	if book == nil {
+		return nil
+	}
+	order := book.orders[id]
+	book.expire(order)
+	return order
+}
+
+// writeExpired writes a line like "expire 3" to w for each of the
+// expired orders.
+func writeExpired(w io.Writer, expired []*Order) {
+	for _, order := range expired {
+		fmt.Fprintf(w, "expire %v\n", order.id)
+	}
+}
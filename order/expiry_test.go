@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExchange_Expire(t *testing.T) {
+	ex := newExchange()
+	for _, line := range []string{
+		// There is no time yet to count the day from.
+		"stop sell 5 98.00 day",
+		"limit buy 10 99.00 gtt=300 sym=MSFT time=100",
+		"limit buy 10 99.00 gtt=200 sym=AAPL time=100",
+		"limit sell 10 101.00 gtt=200",
+		"limit buy 5 98.00 day time=100",
+		"limit buy 5 97.00 gtt=150",
+	} {
+		if _, err := ex.Add(newOrder(line)); err != nil {
+			t.Fatalf("Add(%q) got error %v", line, err)
+		}
+	}
+	cancel := newOrder("cancel na 4 0.00")
+	if _, err := ex.Add(cancel); err != nil {
+		t.Fatalf("Add(%v) got error %v", cancel, err)
+	}
+
+	cases := []struct {
+		t    int64
+		want []OrderNumber
+	}{
+		{149, []OrderNumber{}},
+		{150, []OrderNumber{6}},
+		// Cancelled orders don't expire.
+		{250, []OrderNumber{3}},
+		// Time doesn't go back.
+		{50, nil},
+		{secondsPerDay, []OrderNumber{2, 5}},
+		{10 * secondsPerDay, []OrderNumber{}},
+	}
+	for _, tc := range cases {
+		got := []OrderNumber{}
+		expired := ex.Expire(tc.t)
+		for _, order := range expired {
+			got = append(got, order.id)
+			if !order.cancelled || ex.bookOf(order.id) != nil {
+				t.Errorf("Expire(%v): got order %v still open", tc.t, order.id)
+			}
+		}
+		if tc.want == nil && expired != nil || fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("Expire(%v): got %v; want %v", tc.t, got, tc.want)
+		}
+	}
+	if ex.bookOf(1) == nil {
+		t.Errorf("got stop order 1 expired; want it resting")
+	}
+}
+
+func TestJournal_modifiedExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	in := strings.Join([]string{
+		"limit buy 10 99.00 gtt=100 time=10",
+		"modify na 1 99.50 10 time=20",
+		"stoplimit sell 5 99.50 99.60 gtt=100 time=30",
+		"market sell 1 0.00 time=40",
+		"limit sell 1 200.00 time=200",
+	}, "\n")
+	want := "match 4 1 1 99.50\nexpire 1\nexpire 3\n"
+	if got := runJournaled(t, path, []byte(in)); got != want {
+		t.Errorf("got output (-want +got):\n%s", diffLines(got, want))
+	}
+	if got := replayed(t, path); got != want {
+		t.Errorf("got replay (-want +got):\n%s", diffLines(got, want))
+	}
+	// The journal can be reopened.
+	runJournaled(t, path, nil)
+}
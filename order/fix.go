@@ -0,0 +1,816 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FIX 4.4 tags used by the FIX acceptor.
+const (
+	tagAccount          = 1
+	tagAvgPx            = 6
+	tagBeginString      = 8
+	tagBodyLength       = 9
+	tagCheckSum         = 10
+	tagClOrdID          = 11
+	tagCumQty           = 14
+	tagExecID           = 17
+	tagExecInst         = 18
+	tagLastPx           = 31
+	tagLastQty          = 32
+	tagMsgSeqNum        = 34
+	tagMsgType          = 35
+	tagOrderID          = 37
+	tagOrderQty         = 38
+	tagOrdStatus        = 39
+	tagOrdType          = 40
+	tagOrigClOrdID      = 41
+	tagPrice            = 44
+	tagSenderCompID     = 49
+	tagSendingTime      = 52
+	tagSide             = 54
+	tagSymbol           = 55
+	tagTargetCompID     = 56
+	tagText             = 58
+	tagTimeInForce      = 59
+	tagTransactTime     = 60
+	tagStopPx           = 99
+	tagCxlRejReason     = 102
+	tagMaxFloor         = 111
+	tagExpireTime       = 126
+	tagExecType         = 150
+	tagLeavesQty        = 151
+	tagCxlRejResponseTo = 434
+)
+
+// Values of MsgType (35) handled by the FIX acceptor.
+const (
+	fixNewOrderSingle            = "D"
+	fixOrderCancelRequest        = "F"
+	fixOrderCancelReplaceRequest = "G"
+	fixExecutionReport           = "8"
+	fixOrderCancelReject         = "9"
+)
+
+// Values of ExecType (150) and OrdStatus (39) in execution reports.
+const (
+	fixNew             = "0"
+	fixPartiallyFilled = "1"
+	fixFilled          = "2"
+	fixCanceled        = "4"
+	fixReplaced        = "5"
+	fixRejected        = "8"
+	fixExpired         = "C"
+	fixTrade           = "F"
+)
+
+// Values of CxlRejReason (102) in cancel rejects.
+const (
+	fixTooLateToCancel  = "0"
+	fixUnknownOrder     = "1"
+	fixDuplicateClOrdID = "6"
+	fixOtherReason      = "99"
+)
+
+// fixVersion is the BeginString (8) of FIX 4.4 messages.
+const fixVersion = "FIX.4.4"
+
+// maxFIXBody is the largest BodyLength (9) accepted.
+const maxFIXBody = 1 << 16
+
+// fixTimestamp is the layout of UTCTimestamp fields. Parsing also accepts
+// fractional seconds.
+const fixTimestamp = "20060102-15:04:05"
+
+var (
+	// errFIX is the error for malformed FIX messages.
+	errFIX = errors.New("invalid FIX message")
+	// errChecksum is the error for FIX messages with a wrong CheckSum
+	// (10), which are dropped.
+	errChecksum = errors.New("wrong FIX checksum")
+
+	// fixSides holds the OrderSide of each value of Side (54).
+	fixSides = map[string]OrderSide{"1": BuySide, "2": SellSide}
+	// fixTimeInForces holds the order option for each value of
+	// TimeInForce (59), other than GoodTillDate (6). Orders without it
+	// are GoodTillCancel, as for ParseOrder.
+	fixTimeInForces = map[string]string{"0": " day", "1": "", "3": " ioc", "4": " fok"}
+)
+
+type (
+	// fixField is a tag=value field of a FIX message.
+	fixField struct {
+		tag   int
+		value string
+	}
+
+	// fixMessage is the fields of a FIX message, starting with MsgType
+	// (35), i.e. without BeginString (8), BodyLength (9) and CheckSum
+	// (10).
+	fixMessage []fixField
+
+	// fixAcceptor accepts FIX 4.4 messages from many clients over TCP, and
+	// adds the orders they describe to an Exchange. It sends back
+	// execution reports for the orders of each client.
+	//
+	// It handles NewOrderSingle, OrderCancelRequest and
+	// OrderCancelReplaceRequest messages, and ignores any others. There
+	// are no FIX sessions: the acceptor doesn't log on, send heartbeats,
+	// or resend messages. Symbol (55) "-" stands for the default
+	// instrument, as orders without it.
+	//
+	// As for the gateway, a sequencer owns the Exchange.
+	fixAcceptor struct {
+		*sequencer
+		// orders holds each Order from a client that may still execute,
+		// by number. It is only used by the sequencer.
+		orders map[OrderNumber]*fixOrder
+		// execID is the ExecID (17) of the last execution report.
+		execID uint64
+	}
+
+	// fixClient is a connection to the FIX acceptor.
+	fixClient struct {
+		*client
+		// sender and target are the SenderCompID (49) and TargetCompID
+		// (56) of the last message from the client, which are swapped in
+		// the messages to it.
+		sender, target string
+		// seq is the MsgSeqNum (34) of the last message to the client.
+		seq int
+		// ids holds the number of the Order for each ClOrdID (11) the
+		// client has used.
+		ids map[string]OrderNumber
+		// done holds the final OrdStatus (39) of each Order of the client
+		// that can no longer execute, by number.
+		done map[OrderNumber]string
+	}
+
+	// fixOrder is an Order from a client of the FIX acceptor.
+	fixOrder struct {
+		from  *fixClient
+		order *Order
+		// clOrdID is the ClOrdID (11) of the last request for the Order,
+		// and origClOrdID the one before it, for cancels and replaces.
+		clOrdID, origClOrdID string
+		// cumQty is the number of units executed so far, and notional
+		// the money they traded for.
+		cumQty   Volume
+		notional Price
+		// status is the OrdStatus (39) of the Order once it can no
+		// longer execute, or "" while it can.
+		status string
+	}
+)
+
+// get returns the value of the first field with tag in m, or "" if
+// there is none.
+func (m fixMessage) get(tag int) string {
+	for _, f := range m {
+		if f.tag == tag {
+			return f.value
+		}
+	}
+	return ""
+}
+
+// String returns m in the tag=value format, with "|" between fields.
+func (m fixMessage) String() string {
+	fields := []string{}
+	for _, f := range m {
+		fields = append(fields, fmt.Sprintf("%d=%s", f.tag, f.value))
+	}
+	return strings.Join(fields, "|")
+}
+
+// encode returns m as a FIX 4.4 message on the wire, adding its
+// BeginString (8), BodyLength (9) and CheckSum (10).
+func (m fixMessage) encode() string {
+	var body strings.Builder
+	for _, f := range m {
+		fmt.Fprintf(&body, "%d=%s\x01", f.tag, f.value)
+	}
+	msg := fmt.Sprintf("%d=%s\x01%d=%d\x01%s", tagBeginString, fixVersion, tagBodyLength, body.Len(), body.String())
+	return fmt.Sprintf("%s%d=%03d\x01", msg, tagCheckSum, fixChecksum(msg))
+}
+
+// fixChecksum returns the sum of the bytes of s modulo 256.
+func fixChecksum(s string) int {
+	sum := 0
+	for i := 0; i < len(s); i++ {
+		sum += int(s[i])
+	}
+	return sum % 256
+}
+
+// readFIXField returns the next field in r, and the raw bytes it was
+// read from.
+func readFIXField(r *bufio.Reader) (fixField, string, error) {
+	raw, err := r.ReadString('\x01')
+	if err != nil {
+		return fixField{}, raw, err
+	}
+	tagstr, value, ok := strings.Cut(strings.TrimSuffix(raw, "\x01"), "=")
+	tag, err := strconv.Atoi(tagstr)
+	if !ok || err != nil || tag <= 0 {
+		return fixField{}, raw, fmt.Errorf("%w: bad field %q", errFIX, raw)
+	}
+	return fixField{tag, value}, raw, nil
+}
+
+// readFIX returns the next FIX 4.4 message in r.
+//
+// io.EOF is returned at the end of r. A message with the wrong CheckSum
+// (10) gives errChecksum, and may be skipped, while other errors leave r
+// at an unknown position.
+func readFIX(r *bufio.Reader) (fixMessage, error) {
+	begin, raw, err := readFIXField(r)
+	if err == io.EOF && raw == "" {
+		return nil, io.EOF
+	}
+	if err == nil && (begin.tag != tagBeginString || begin.value != fixVersion) {
+		err = fmt.Errorf("%w: got %q; want %d=%s", errFIX, raw, tagBeginString, fixVersion)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Past the first field, the end of r means the message is
+	// truncated.
+	field := func(r *bufio.Reader) (fixField, string, error) {
+		f, raw, err := readFIXField(r)
+		if err == io.EOF {
+			err = fmt.Errorf("%w: truncated at %q", errFIX, raw)
+		}
+		return f, raw, err
+	}
+	length, rawLength, err := field(r)
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(length.value)
+	if length.tag != tagBodyLength || err != nil || n < 0 || n > maxFIXBody {
+		return nil, fmt.Errorf("%w: bad body length %q", errFIX, rawLength)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("%w: truncated body: %v", errFIX, err)
+	}
+	trailer, rawTrailer, err := field(r)
+	if err != nil {
+		return nil, err
+	}
+	if trailer.tag != tagCheckSum {
+		return nil, fmt.Errorf("%w: got %q; want checksum", errFIX, rawTrailer)
+	}
+	if sum := fmt.Sprintf("%03d", fixChecksum(raw+rawLength+string(body))); trailer.value != sum {
+		return nil, fmt.Errorf("%w: got %s; want %s", errChecksum, trailer.value, sum)
+	}
+
+	msg := fixMessage{}
+	br := bufio.NewReader(strings.NewReader(string(body)))
+	for {
+		f, raw, err := readFIXField(br)
+		if err == io.EOF && raw == "" {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad body %q", errFIX, body)
+		}
+		msg = append(msg, f)
+	}
+	if len(msg) == 0 || msg[0].tag != tagMsgType {
+		return nil, fmt.Errorf("%w: body doesn't start with MsgType: %q", errFIX, body)
+	}
+	return msg, nil
+}
+
+// fixTime returns the time in the UTCTimestamp field with tag in msg, in
+// seconds since the Unix epoch, or 0 if there is none.
+func fixTime(msg fixMessage, tag int) (int64, error) {
+	s := msg.get(tag)
+	if s == "" {
+		return 0, nil
+	}
+	t, err := time.Parse(fixTimestamp, s)
+	if err != nil || t.Unix() <= 0 {
+		return 0, fmt.Errorf("invalid UTCTimestamp %q in tag %d", s, tag)
+	}
+	return t.Unix(), nil
+}
+
+// require returns the values of the fields with tags in msg, or an error
+// naming the first one that is missing.
+func require(msg fixMessage, tags ...int) ([]string, error) {
+	values := []string{}
+	for _, tag := range tags {
+		value := msg.get(tag)
+		if value == "" {
+			return nil, fmt.Errorf("missing tag %d", tag)
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// fixOrderLine returns the order described by the NewOrderSingle msg, in
+// the format of ParseOrder.
+//
+// OrdType (40) may be Market (1), Limit (2), Stop (3) or StopLimit (4).
+// TimeInForce (59) may be Day (0), GoodTillCancel (1), which is the
+// default, ImmediateOrCancel (3), FillOrKill (4) or GoodTillDate (6)
+// with an ExpireTime (126), and is ignored for Market orders. ExecInst
+// (18) including
+// ParticipateDontInitiate (6) makes a PostOnly order, and MaxFloor (111)
+// an iceberg order. TransactTime (60) becomes the Time of the order.
+func fixOrderLine(msg fixMessage) (string, error) {
+	values, err := require(msg, tagSide, tagOrderQty, tagOrdType)
+	if err != nil {
+		return "", err
+	}
+	side, ok := fixSides[values[0]]
+	if !ok {
+		return "", fmt.Errorf("unsupported side %q", values[0])
+	}
+	var prices []int
+	var typ string
+	switch values[2] {
+	case "1":
+		typ = "market"
+	case "2":
+		typ, prices = "limit", []int{tagPrice}
+	case "3":
+		typ, prices = "stop", []int{tagStopPx}
+	case "4":
+		typ, prices = "stoplimit", []int{tagStopPx, tagPrice}
+	default:
+		return "", fmt.Errorf("unsupported order type %q", values[2])
+	}
+	line := fmt.Sprintf("%s %v %s", typ, side, values[1])
+	if typ == "market" {
+		line += " 0.00"
+	}
+	p, err := require(msg, prices...)
+	if err != nil {
+		return "", err
+	}
+	for _, price := range p {
+		line += " " + price
+	}
+
+	switch tif := msg.get(tagTimeInForce); {
+	case typ == "market":
+		// Market orders never rest in the book.
+	case tif == "6":
+		expiry, err := fixTime(msg, tagExpireTime)
+		if err != nil {
+			return "", err
+		}
+		if expiry == 0 {
+			return "", fmt.Errorf("missing tag %d", tagExpireTime)
+		}
+		line += fmt.Sprintf(" gtt=%d", expiry)
+	case tif == "":
+	default:
+		opt, ok := fixTimeInForces[tif]
+		if !ok {
+			return "", fmt.Errorf("unsupported time in force %q", tif)
+		}
+		line += opt
+	}
+	for _, inst := range strings.Fields(msg.get(tagExecInst)) {
+		if inst == "6" {
+			line += " post"
+		}
+	}
+	if peak := msg.get(tagMaxFloor); peak != "" {
+		line += " peak=" + peak
+	}
+	if symbol := msg.get(tagSymbol); symbol != "" && symbol != fixSymbol("") {
+		line += " sym=" + symbol
+	}
+	if acct := msg.get(tagAccount); acct != "" {
+		line += " acct=" + acct
+	}
+	t, err := fixTime(msg, tagTransactTime)
+	if err != nil {
+		return "", err
+	}
+	if t > 0 {
+		line += fmt.Sprintf(" time=%d", t)
+	}
+	return line, nil
+}
+
+// newFIXAcceptor returns a FIX acceptor adding orders to ex, and starts
+// its sequencer.
+func newFIXAcceptor(ex *Exchange) *fixAcceptor {
+	return &fixAcceptor{
+		sequencer: newSequencer(ex),
+		orders:    map[OrderNumber]*fixOrder{},
+	}
+}
+
+// serve accepts clients on l until it is closed.
+func (a *fixAcceptor) serve(l net.Listener) error {
+	return a.sequencer.serve(l, func(c *client) {
+		a.read(&fixClient{
+			client: c,
+			ids:    map[string]OrderNumber{},
+			done:   map[OrderNumber]string{},
+		})
+	})
+}
+
+// read passes the messages from c to the sequencer, until c disconnects
+// or sends a malformed message. Messages with the wrong checksum are
+// dropped.
+func (a *fixAcceptor) read(c *fixClient) {
+	r := bufio.NewReader(c.conn)
+	for {
+		msg, err := readFIX(r)
+		if errors.Is(err, errChecksum) {
+			info("Dropped FIX message from %v: %v\n", c.conn.RemoteAddr(), err)
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				info("Disconnecting %v: %v\n", c.conn.RemoteAddr(), err)
+				c.conn.Close()
+			}
+			break
+		}
+		a.requests <- request{from: c.client, run: func() { a.handle(c, msg) }}
+	}
+	a.requests <- request{from: c.client, closing: true}
+}
+
+// handle adds the orders in msg from c to the Exchange, and sends the
+// execution reports to the clients concerned.
+func (a *fixAcceptor) handle(c *fixClient, msg fixMessage) {
+	if sender := msg.get(tagSenderCompID); sender != "" {
+		c.sender = sender
+	}
+	if target := msg.get(tagTargetCompID); target != "" {
+		c.target = target
+	}
+	switch msg.get(tagMsgType) {
+	case fixNewOrderSingle:
+		a.newOrder(c, msg)
+	case fixOrderCancelRequest, fixOrderCancelReplaceRequest:
+		a.amend(c, msg)
+	default:
+		debug("Ignoring FIX message %v\n", msg)
+	}
+	a.dropped()
+}
+
+// newOrder adds the order in the NewOrderSingle msg from c.
+func (a *fixAcceptor) newOrder(c *fixClient, msg fixMessage) {
+	clOrdID := msg.get(tagClOrdID)
+	if clOrdID == "" {
+		a.reject(c, msg, nil, fmt.Sprintf("missing tag %d", tagClOrdID))
+		return
+	}
+	if _, ok := c.ids[clOrdID]; ok {
+		a.reject(c, msg, nil, fmt.Sprintf("duplicate ClOrdID %q", clOrdID))
+		return
+	}
+	line, err := fixOrderLine(msg)
+	var order *Order
+	if err == nil {
+		order, err = ParseOrder(line)
+	}
+	if err != nil {
+		a.reject(c, msg, nil, err.Error())
+		return
+	}
+	a.expire(order.Time)
+	matches, err := a.ex.Add(order)
+	if r, ok := err.(*Reject); ok {
+		a.reject(c, msg, &fixOrder{order: order, status: fixRejected}, r.Reason)
+		return
+	} else if err != nil {
+		a.reject(c, msg, nil, err.Error())
+		return
+	}
+	fo := &fixOrder{from: c, order: order, clOrdID: clOrdID}
+	a.orders[order.id] = fo
+	c.ids[clOrdID] = order.id
+	a.report(fo, fixNew)
+	a.fills(fo, matches)
+}
+
+// amend cancels or replaces the order given by OrigClOrdID (41) in the
+// OrderCancelRequest or OrderCancelReplaceRequest msg from c.
+//
+// A replace changes the OrderQty (38) and the Price (44), or the StopPx
+// (99) of Stop orders, as for Modify orders.
+func (a *fixAcceptor) amend(c *fixClient, msg fixMessage) {
+	values, err := require(msg, tagClOrdID, tagOrigClOrdID)
+	if err != nil {
+		a.cancelReject(c, msg, nil, fixOtherReason, err.Error())
+		return
+	}
+	clOrdID, orig := values[0], values[1]
+	if _, ok := c.ids[clOrdID]; ok {
+		a.cancelReject(c, msg, nil, fixDuplicateClOrdID, fmt.Sprintf("duplicate ClOrdID %q", clOrdID))
+		return
+	}
+	id := c.ids[orig]
+	fo, ok := a.orders[id]
+	if status, done := c.done[id]; !ok && done {
+		// Only the OrdStatus of orders that are done is kept.
+		finished := &fixOrder{order: &Order{id: id}, status: status}
+		a.cancelReject(c, msg, finished, fixTooLateToCancel, fmt.Sprintf("no open order %q", orig))
+		return
+	}
+	if !ok {
+		a.cancelReject(c, msg, nil, fixUnknownOrder, fmt.Sprintf("no open order %q", orig))
+		return
+	}
+	line := fmt.Sprintf("cancel na %v 0", fo.order.id)
+	if msg.get(tagMsgType) == fixOrderCancelReplaceRequest {
+		priceTag := tagPrice
+		if fo.order.Type == Stop {
+			priceTag = tagStopPx
+		}
+		values, err := require(msg, priceTag, tagOrderQty)
+		if err != nil {
+			a.cancelReject(c, msg, fo, fixOtherReason, err.Error())
+			return
+		}
+		line = fmt.Sprintf("modify na %v %s %s", fo.order.id, values[0], values[1])
+	}
+	t, err := fixTime(msg, tagTransactTime)
+	if err == nil && t > 0 {
+		line += fmt.Sprintf(" time=%d", t)
+	}
+	var order *Order
+	if err == nil {
+		order, err = ParseOrder(line)
+	}
+	if err != nil {
+		a.cancelReject(c, msg, fo, fixOtherReason, err.Error())
+		return
+	}
+	a.expire(order.Time)
+	if fo.status != "" {
+		a.cancelReject(c, msg, fo, fixTooLateToCancel, fmt.Sprintf("no open order %q", orig))
+		return
+	}
+	matches, err := a.ex.Add(order)
+	if r, ok := err.(*Reject); ok {
+		a.cancelReject(c, msg, fo, fixOtherReason, r.Reason)
+		return
+	} else if err != nil {
+		a.cancelReject(c, msg, fo, fixOtherReason, err.Error())
+		return
+	}
+	c.ids[clOrdID] = fo.order.id
+	fo.clOrdID, fo.origClOrdID = clOrdID, orig
+	if order.Type == Cancel {
+		fo.status = fixCanceled
+		a.report(fo, fixCanceled)
+		a.forget(fo)
+		return
+	}
+	a.report(fo, fixReplaced)
+	a.fills(fo, matches)
+}
+
+// expire expires the orders in the Exchange due by t, and reports the
+// expiry of those from clients.
+func (a *fixAcceptor) expire(t int64) {
+	for _, order := range a.ex.Expire(t) {
+		if fo, ok := a.orders[order.id]; ok {
+			fo.status = fixExpired
+			a.report(fo, fixExpired)
+			a.forget(fo)
+		}
+	}
+}
+
+// fills reports the matches caused by a request for fo to the clients
+// of their orders, followed by the cancellation of any of those orders,
+// or fo, that are neither executed nor resting in the book, e.g. the
+// rest of Market and ImmediateOrCancel orders.
+func (a *fixAcceptor) fills(fo *fixOrder, matches Matches) {
+	involved := []*fixOrder{fo}
+	for _, m := range matches {
+		for _, o := range []*Order{m.Taker, m.Maker} {
+			fo, ok := a.orders[o.id]
+			if !ok {
+				continue
+			}
+			fo.cumQty += m.Volume
+			fo.notional += Price(m.Volume) * m.Price
+			a.report(fo, fixTrade, fixField{tagLastQty, fmt.Sprint(m.Volume)}, fixField{tagLastPx, m.Price.String()})
+			involved = append(involved, fo)
+		}
+	}
+	for _, fo := range involved {
+		if fo.status == "" && !fo.order.executed && fo.order.level == nil {
+			fo.status = fixCanceled
+			a.report(fo, fixCanceled)
+		}
+	}
+	// Orders that can't execute further are forgotten.
+	for _, fo := range involved {
+		if fo.order.level == nil {
+			a.forget(fo)
+		}
+	}
+}
+
+// dropped reports the cancellation of the orders from clients that the
+// books cancelled, or triggered without executing or resting them, while
+// running the last request, e.g. by self-trade prevention.
+func (a *fixAcceptor) dropped() {
+	for _, id := range append(a.cancelled, a.triggered...) {
+		fo, ok := a.orders[id]
+		if !ok || fo.order.level != nil {
+			continue
+		}
+		if fo.status == "" && !fo.order.executed {
+			fo.status = fixCanceled
+			a.report(fo, fixCanceled)
+		}
+		a.forget(fo)
+	}
+	a.cancelled, a.triggered = nil, nil
+}
+
+// forget forgets fo, which can no longer execute, keeping only its
+// final OrdStatus (39) for its client.
+func (a *fixAcceptor) forget(fo *fixOrder) {
+	delete(a.orders, fo.order.id)
+	fo.from.done[fo.order.id] = fo.ordStatus()
+}
+
+// ordStatus returns the OrdStatus (39) of fo.
+func (fo *fixOrder) ordStatus() string {
+	switch {
+	case fo.status != "":
+		return fo.status
+	case fo.cumQty >= fo.order.Volume:
+		return fixFilled
+	case fo.cumQty > 0:
+		return fixPartiallyFilled
+	}
+	return fixNew
+}
+
+// avgPx returns the AvgPx (6) of fo, which is exact rather than on the
+// tick grid.
+func (fo *fixOrder) avgPx() string {
+	if fo.cumQty == 0 {
+		return "0"
+	}
+	if fo.notional%Price(fo.cumQty) == 0 {
+		return (fo.notional / Price(fo.cumQty)).String()
+	}
+	tick, _ := strconv.ParseFloat(Price(1).String(), 64)
+	return strconv.FormatFloat(float64(fo.notional)/float64(fo.cumQty)*tick, 'f', -1, 64)
+}
+
+// fixSymbol returns the value of Symbol (55) for orders of the
+// instrument symbol, which is "-" for the default instrument.
+func fixSymbol(symbol string) string {
+	if symbol == "" {
+		return "-"
+	}
+	return symbol
+}
+
+// fixSide returns the value of Side (54) for side.
+func fixSide(side OrderSide) string {
+	if side == BuySide {
+		return "1"
+	}
+	return "2"
+}
+
+// report sends an execution report of execType for fo to its client,
+// with any extra fields at the end.
+func (a *fixAcceptor) report(fo *fixOrder, execType string, extra ...fixField) {
+	o := fo.order
+	a.execID++
+	msg := fixMessage{
+		{tagMsgType, fixExecutionReport},
+		{tagOrderID, fmt.Sprint(o.id)},
+		{tagClOrdID, fo.clOrdID},
+	}
+	if fo.origClOrdID != "" {
+		msg = append(msg, fixField{tagOrigClOrdID, fo.origClOrdID})
+	}
+	msg = append(msg,
+		fixField{tagExecID, fmt.Sprint(a.execID)},
+		fixField{tagExecType, execType},
+		fixField{tagOrdStatus, fo.ordStatus()},
+		fixField{tagSymbol, fixSymbol(o.Symbol)},
+	)
+	leaves := o.Volume - fo.cumQty
+	if fo.status != "" {
+		leaves = 0
+	}
+	msg = append(msg,
+		fixField{tagSide, fixSide(o.Side)},
+		fixField{tagOrderQty, fmt.Sprint(o.Volume)},
+		fixField{tagLeavesQty, fmt.Sprint(leaves)},
+		fixField{tagCumQty, fmt.Sprint(fo.cumQty)},
+		fixField{tagAvgPx, fo.avgPx()},
+	)
+	fo.from.send(append(msg, extra...))
+}
+
+// reject sends a rejected execution report for the NewOrderSingle msg to
+// c, explaining why in text. target is the order that msg refers to, if
+// known, whose OrdStatus is reported.
+func (a *fixAcceptor) reject(c *fixClient, msg fixMessage, target *fixOrder, text string) {
+	a.execID++
+	orderID, status := "NONE", fixRejected
+	if target != nil {
+		orderID, status = fmt.Sprint(target.order.id), target.ordStatus()
+	}
+	report := fixMessage{
+		{tagMsgType, fixExecutionReport},
+		{tagOrderID, orderID},
+	}
+	for _, tag := range []int{tagClOrdID, tagOrigClOrdID} {
+		if value := msg.get(tag); value != "" {
+			report = append(report, fixField{tag, value})
+		}
+	}
+	report = append(report,
+		fixField{tagExecID, fmt.Sprint(a.execID)},
+		fixField{tagExecType, fixRejected},
+		fixField{tagOrdStatus, status},
+		fixField{tagSymbol, fixSymbol(msg.get(tagSymbol))},
+	)
+	for _, tag := range []int{tagSide, tagOrderQty} {
+		if value := msg.get(tag); value != "" {
+			report = append(report, fixField{tag, value})
+		}
+	}
+	c.send(append(report,
+		fixField{tagLeavesQty, "0"},
+		fixField{tagCumQty, "0"},
+		fixField{tagAvgPx, "0"},
+		fixField{tagText, text},
+	))
+}
+
+// cancelReject sends an OrderCancelReject for the OrderCancelRequest or
+// OrderCancelReplaceRequest msg to c, with the CxlRejReason (102) reason
+// and an explanation in text. target is the order that msg refers to, if
+// known, whose OrdStatus is reported.
+func (a *fixAcceptor) cancelReject(c *fixClient, msg fixMessage, target *fixOrder, reason, text string) {
+	orderID, status := "NONE", fixRejected
+	if target != nil {
+		orderID, status = fmt.Sprint(target.order.id), target.ordStatus()
+	}
+	report := fixMessage{
+		{tagMsgType, fixOrderCancelReject},
+		{tagOrderID, orderID},
+	}
+	for _, tag := range []int{tagClOrdID, tagOrigClOrdID} {
+		if value := msg.get(tag); value != "" {
+			report = append(report, fixField{tag, value})
+		}
+	}
+	// CxlRejResponseTo is 1 for cancels, and 2 for replaces.
+	responseTo := "1"
+	if msg.get(tagMsgType) == fixOrderCancelReplaceRequest {
+		responseTo = "2"
+	}
+	c.send(append(report,
+		fixField{tagOrdStatus, status},
+		fixField{tagCxlRejResponseTo, responseTo},
+		fixField{tagCxlRejReason, reason},
+		fixField{tagText, text},
+	))
+}
+
+// send queues msg to be written to c, adding the header fields that
+// identify c and the SendingTime (52) in milliseconds.
+func (c *fixClient) send(msg fixMessage) {
+	c.seq++
+	header := fixMessage{msg[0]}
+	if c.target != "" {
+		header = append(header, fixField{tagSenderCompID, c.target})
+	}
+	if c.sender != "" {
+		header = append(header, fixField{tagTargetCompID, c.sender})
+	}
+	header = append(header,
+		fixField{tagMsgSeqNum, fmt.Sprint(c.seq)},
+		fixField{tagSendingTime, time.Now().UTC().Format(fixTimestamp + ".000")},
+	)
+	c.queue(append(header, msg[1:]...).encode())
+}
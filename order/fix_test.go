@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fix returns the message given as "tag=value" fields separated by "|",
+// such as "35=D|11=a1".
+func fix(s string) fixMessage {
+	msg, err := readFIX(bufio.NewReader(strings.NewReader(fixMessageFields(s).encode())))
+	if err != nil {
+		panic(err)
+	}
+	return msg
+}
+
+// fixMessageFields returns the fields in s, as for fix, without decoding
+// them.
+func fixMessageFields(s string) fixMessage {
+	msg := fixMessage{}
+	for _, field := range strings.Split(s, "|") {
+		tag, value, _ := strings.Cut(field, "=")
+		n := 0
+		for _, c := range tag {
+			n = n*10 + int(c-'0')
+		}
+		msg = append(msg, fixField{n, value})
+	}
+	return msg
+}
+
+func TestFIXMessage_encode(t *testing.T) {
+	msg := fixMessage{{tagMsgType, "D"}, {tagClOrdID, "a1"}, {tagOrderQty, "10"}, {tagSide, "1"}}
+	want := "8=FIX.4.4\x019=22\x0135=D\x0111=a1\x0138=10\x0154=1\x0110=250\x01"
+	got := msg.encode()
+	if got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	r := bufio.NewReader(strings.NewReader(got + strings.Replace(got, "a1", "b1", 1) + got))
+	if parsed, err := readFIX(r); err != nil || parsed.String() != msg.String() {
+		t.Errorf("readFIX() got %v, %v; want %v", parsed, err, msg)
+	}
+	if _, err := readFIX(r); !errors.Is(err, errChecksum) {
+		t.Errorf("readFIX() got error %v; want %v", err, errChecksum)
+	}
+	if _, err := readFIX(r); err != nil {
+		t.Errorf("readFIX() got error %v after bad checksum; want nil", err)
+	}
+	if _, err := readFIX(r); err != io.EOF {
+		t.Errorf("readFIX() got error %v at end; want io.EOF", err)
+	}
+
+	for _, in := range []string{
+		"8=FIX.4.2\x019=5\x0135=D\x0110=000\x01",
+		"8=FIX.4.4\x019=x\x0135=D\x0110=000\x01",
+		"8=FIX.4.4\x019=5\x0111=a\x0110=206\x01",
+		"8=FIX.4.4\x019=5\x0135=D\x01",
+		"8=FIX.4.4\x01x=5\x01",
+	} {
+		if _, err := readFIX(bufio.NewReader(strings.NewReader(in))); !errors.Is(err, errFIX) {
+			t.Errorf("readFIX(%q) got error %v; want %v", in, err, errFIX)
+		}
+	}
+}
+
+func TestFIXOrderLine(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    string
+		wantErr string
+	}{
+		{in: "35=D|54=1|38=10|40=1|59=0", want: "market buy 10 0.00"},
+		{in: "35=D|54=2|38=10|40=2|44=99.5|55=AAPL|1=alice", want: "limit sell 10 99.5 sym=AAPL acct=alice"},
+		{in: "35=D|54=1|38=10|40=2|44=99|55=-", want: "limit buy 10 99"},
+		{in: "35=D|54=1|38=10|40=3|99=101", want: "stop buy 10 101"},
+		{in: "35=D|54=1|38=10|40=4|99=101|44=101.5|59=3", want: "stoplimit buy 10 101 101.5 ioc"},
+		{in: "35=D|54=1|38=10|40=2|44=99|59=0|18=6|111=2", want: "limit buy 10 99 day post peak=2"},
+		{
+			in:   "35=D|54=1|38=10|40=2|44=99|59=6|126=20231114-22:14:20|60=20231114-22:13:20.123",
+			want: "limit buy 10 99 gtt=1700000060 time=1700000000",
+		},
+		{in: "35=D|54=1|38=10|40=2", wantErr: "missing tag 44"},
+		{in: "35=D|54=1|40=2|44=99", wantErr: "missing tag 38"},
+		{in: "35=D|54=5|38=10|40=2|44=99", wantErr: `unsupported side "5"`},
+		{in: "35=D|54=1|38=10|40=P|44=99", wantErr: `unsupported order type "P"`},
+		{in: "35=D|54=1|38=10|40=2|44=99|59=2", wantErr: `unsupported time in force "2"`},
+		{in: "35=D|54=1|38=10|40=2|44=99|59=6", wantErr: "missing tag 126"},
+		{in: "35=D|54=1|38=10|40=2|44=99|60=yesterday", wantErr: `invalid UTCTimestamp "yesterday" in tag 60`},
+	}
+	for _, tc := range cases {
+		got, err := fixOrderLine(fix(tc.in))
+		if tc.wantErr != "" {
+			if err == nil || err.Error() != tc.wantErr {
+				t.Errorf("%s: got error %v; want %q", tc.in, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("%s: got %q, %v; want %q", tc.in, got, err, tc.want)
+		}
+	}
+}
+
+// fixTestClient is a connection to a FIX acceptor.
+type fixTestClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialFIX(t *testing.T, addr string) *fixTestClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	// Fail rather than hang if an expected report never comes.
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &fixTestClient{t, conn, bufio.NewReader(conn)}
+}
+
+// send sends the message given as for fix, and returns the next n
+// messages from the acceptor.
+func (c *fixTestClient) send(s string, n int) []string {
+	if _, err := io.WriteString(c.conn, fixMessageFields(s).encode()); err != nil {
+		c.t.Errorf("failed to send %q: %v", s, err)
+		return nil
+	}
+	return c.read(n)
+}
+
+// read returns the next n messages from the acceptor, leaving out their
+// SendingTime (52), which must be about now.
+func (c *fixTestClient) read(n int) []string {
+	msgs := []string{}
+	for len(msgs) < n {
+		msg, err := readFIX(c.r)
+		if err != nil {
+			c.t.Errorf("failed to read: %v", err)
+			break
+		}
+		fields := fixMessage{}
+		for _, f := range msg {
+			if f.tag != tagSendingTime {
+				fields = append(fields, f)
+			}
+		}
+		sent, err := fixTime(msg, tagSendingTime)
+		if err != nil || sent == 0 || time.Since(time.Unix(sent, 0)).Abs() > time.Minute {
+			c.t.Errorf("got SendingTime %q in %v; want about now", msg.get(tagSendingTime), msg)
+		}
+		msgs = append(msgs, fields.String())
+	}
+	return msgs
+}
+
+func TestFIXAcceptor(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go newFIXAcceptor(newExchange()).serve(l)
+	alice, bob := dialFIX(t, l.Addr().String()), dialFIX(t, l.Addr().String())
+
+	steps := []struct {
+		c     *fixTestClient
+		in    string
+		want  []string
+		other []string
+	}{
+		{
+			alice, "35=D|49=ALICE|56=EX|11=a1|54=2|38=10|40=2|44=100",
+			[]string{"35=8|49=EX|56=ALICE|34=1|37=1|11=a1|17=1|150=0|39=0|55=-|54=2|38=10|151=10|14=0|6=0"},
+			nil,
+		},
+		{
+			bob, "35=D|11=b1|54=1|38=4|40=2|44=100.5|59=3",
+			[]string{
+				"35=8|34=1|37=2|11=b1|17=2|150=0|39=0|55=-|54=1|38=4|151=4|14=0|6=0",
+				"35=8|34=2|37=2|11=b1|17=3|150=F|39=2|55=-|54=1|38=4|151=0|14=4|6=100.00|32=4|31=100.00",
+			},
+			[]string{"35=8|49=EX|56=ALICE|34=2|37=1|11=a1|17=4|150=F|39=1|55=-|54=2|38=10|151=6|14=4|6=100.00|32=4|31=100.00"},
+		},
+		{
+			bob, "35=D|11=b2|54=1|38=9|40=1",
+			[]string{
+				"35=8|34=3|37=3|11=b2|17=5|150=0|39=0|55=-|54=1|38=9|151=9|14=0|6=0",
+				"35=8|34=4|37=3|11=b2|17=6|150=F|39=1|55=-|54=1|38=9|151=3|14=6|6=100.00|32=6|31=100.00",
+				"35=8|34=5|37=3|11=b2|17=8|150=4|39=4|55=-|54=1|38=9|151=0|14=6|6=100.00",
+			},
+			[]string{"35=8|49=EX|56=ALICE|34=3|37=1|11=a1|17=7|150=F|39=2|55=-|54=2|38=10|151=0|14=10|6=100.00|32=6|31=100.00"},
+		},
+		{
+			bob, "35=F|11=b3|41=a1",
+			[]string{`35=9|34=6|37=NONE|11=b3|41=a1|39=8|434=1|102=1|58=no open order "a1"`},
+			nil,
+		},
+		{
+			alice, "35=D|11=a2|54=1|38=5|40=2|44=99|55=AAPL",
+			[]string{"35=8|49=EX|56=ALICE|34=4|37=4|11=a2|17=9|150=0|39=0|55=AAPL|54=1|38=5|151=5|14=0|6=0"},
+			nil,
+		},
+		{
+			alice, "35=G|11=a3|41=a2|38=8|44=98.5",
+			[]string{"35=8|49=EX|56=ALICE|34=5|37=4|11=a3|41=a2|17=10|150=5|39=0|55=AAPL|54=1|38=8|151=8|14=0|6=0"},
+			nil,
+		},
+		{
+			bob, "35=D|11=b4|54=2|38=3|40=2|44=98|55=AAPL",
+			[]string{
+				"35=8|34=7|37=6|11=b4|17=11|150=0|39=0|55=AAPL|54=2|38=3|151=3|14=0|6=0",
+				"35=8|34=8|37=6|11=b4|17=12|150=F|39=2|55=AAPL|54=2|38=3|151=0|14=3|6=98.50|32=3|31=98.50",
+			},
+			[]string{"35=8|49=EX|56=ALICE|34=6|37=4|11=a3|41=a2|17=13|150=F|39=1|55=AAPL|54=1|38=8|151=5|14=3|6=98.50|32=3|31=98.50"},
+		},
+		{
+			alice, "35=G|11=a4|41=a3|38=2|44=98.5",
+			[]string{"35=9|49=EX|56=ALICE|34=7|37=4|11=a4|41=a3|39=1|434=2|102=99|58=order 4 already has 3 units executed"},
+			nil,
+		},
+		{
+			alice, "35=F|11=a5|41=a3",
+			[]string{"35=8|49=EX|56=ALICE|34=8|37=4|11=a5|41=a3|17=14|150=4|39=4|55=AAPL|54=1|38=8|151=0|14=3|6=98.50"},
+			nil,
+		},
+		{
+			alice, "35=D|11=a6|54=1|38=5|40=2",
+			[]string{"35=8|49=EX|56=ALICE|34=9|37=NONE|11=a6|17=15|150=8|39=8|55=-|54=1|38=5|151=0|14=0|6=0|58=missing tag 44"},
+			nil,
+		},
+		{
+			alice, "35=D|11=a1|54=1|38=5|40=1",
+			[]string{`35=8|49=EX|56=ALICE|34=10|37=NONE|11=a1|17=16|150=8|39=8|55=-|54=1|38=5|151=0|14=0|6=0|58=duplicate ClOrdID "a1"`},
+			nil,
+		},
+		// Other messages, such as heartbeats, are ignored.
+		{alice, "35=0", nil, nil},
+	}
+	for i, step := range steps {
+		got := step.c.send(step.in, len(step.want))
+		if strings.Join(got, "\n") != strings.Join(step.want, "\n") {
+			t.Errorf("step %d: %s got (-want +got):\n%s", i+1, step.in, diffLines(strings.Join(got, "\n"), strings.Join(step.want, "\n")))
+		}
+		other := alice
+		if step.c == alice {
+			other = bob
+		}
+		if got := other.read(len(step.other)); strings.Join(got, "\n") != strings.Join(step.other, "\n") {
+			t.Errorf("step %d: %s got for the other client (-want +got):\n%s", i+1, step.in, diffLines(strings.Join(got, "\n"), strings.Join(step.other, "\n")))
+		}
+	}
+}
+
+func TestFIXAcceptor_selfTrade(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	ex := newExchange()
+	ex.stp = CancelOldest
+	go newFIXAcceptor(ex).serve(l)
+	alice := dialFIX(t, l.Addr().String())
+
+	steps := []struct {
+		in   string
+		want []string
+	}{
+		{
+			"35=D|11=a1|54=2|38=10|40=2|44=100|1=x",
+			[]string{"35=8|34=1|37=1|11=a1|17=1|150=0|39=0|55=-|54=2|38=10|151=10|14=0|6=0"},
+		},
+		{
+			// Self-trade prevention cancels order a1.
+			"35=D|11=a2|54=1|38=5|40=2|44=100|1=x",
+			[]string{
+				"35=8|34=2|37=2|11=a2|17=2|150=0|39=0|55=-|54=1|38=5|151=5|14=0|6=0",
+				"35=8|34=3|37=1|11=a1|17=3|150=4|39=4|55=-|54=2|38=10|151=0|14=0|6=0",
+			},
+		},
+		{
+			// Order a1 is done.
+			"35=F|11=a3|41=a1",
+			[]string{`35=9|34=4|37=1|11=a3|41=a1|39=4|434=1|102=0|58=no open order "a1"`},
+		},
+		{
+			"35=D|11=a4|54=2|38=1|40=3|99=100",
+			[]string{"35=8|34=5|37=3|11=a4|17=4|150=0|39=0|55=-|54=2|38=1|151=1|14=0|6=0"},
+		},
+		{
+			// The trade triggers order a4, which finds no buyers.
+			"35=D|11=a5|54=2|38=5|40=2|44=100",
+			[]string{
+				"35=8|34=6|37=4|11=a5|17=5|150=0|39=0|55=-|54=2|38=5|151=5|14=0|6=0",
+				"35=8|34=7|37=4|11=a5|17=6|150=F|39=2|55=-|54=2|38=5|151=0|14=5|6=100.00|32=5|31=100.00",
+				"35=8|34=8|37=2|11=a2|17=7|150=F|39=2|55=-|54=1|38=5|151=0|14=5|6=100.00|32=5|31=100.00",
+				"35=8|34=9|37=3|11=a4|17=8|150=4|39=4|55=-|54=2|38=1|151=0|14=0|6=0",
+			},
+		},
+	}
+	for i, step := range steps {
+		got := alice.send(step.in, len(step.want))
+		if strings.Join(got, "\n") != strings.Join(step.want, "\n") {
+			t.Errorf("step %d: %s got (-want +got):\n%s", i+1, step.in, diffLines(strings.Join(got, "\n"), strings.Join(step.want, "\n")))
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type (
+	// gateway accepts orders from many clients over TCP, and adds them to
+	// an Exchange.
+	//
+	// Clients send orders as lines in the format of ParseOrder, and get
+	// back lines of:
+	//
+	//	ack ID                           the order was added as number ID
+	//	reject ID REASON                 the order was refused by the book
+	//	fill ID VOLUME PRICE REMAINING   order ID of the client executed
+	//	expire ID                        order ID of the client expired
+	//	cancel ID                        order ID of the client was cancelled
+	//	error MESSAGE                    the line was not accepted
+	//
+	// Orders expire by the time of the next order from any client. Orders
+	// are cancelled by the book when self-trade prevention or a modify
+	// stops them from executing; cancelling an order only gets the ack for
+	// the cancel. A fill, expiry or cancel for an order trading a symbol
+	// other than the default instrument is followed by the symbol.
+	//
+	// A sequencer owns the Exchange and adds the orders in the order
+	// they arrive, so matching is strictly serial.
+	gateway struct {
+		*sequencer
+		// owners holds the client that sent each Order that may still
+		// execute. It is only used by the sequencer.
+		owners map[OrderNumber]*client
+	}
+
+	// sequencer owns an Exchange that orders from many clients are added
+	// to. A single goroutine runs the requests of all clients, one at a
+	// time.
+	sequencer struct {
+		ex *Exchange
+		// requests holds the requests from all clients, in arrival order.
+		requests chan request
+		// cancelled and triggered hold the orders that were cancelled or
+		// triggered in the books by the request being run. They are only
+		// used by the sequencer.
+		cancelled, triggered []OrderNumber
+	}
+
+	// client is a connection to the gateway.
+	client struct {
+		conn net.Conn
+		// out holds the messages to write to the client, which are lines
+		// for the gateway.
+		out chan string
+		// closed is true once the client has disconnected, and out is
+		// closed. It is only used by the sequencer.
+		closed bool
+	}
+
+	// request is a request from a client, or a notice that it
+	// disconnected if closing is set. A request from no client stops
+	// the sequencer once it has run.
+	request struct {
+		from *client
+		// run handles the request in the sequencer.
+		run     func()
+		closing bool
+	}
+)
+
+// clientBuffer is the number of messages that may be waiting to be
+// written to a client. Clients that fall further behind are
+// disconnected, so that they don't hold up the sequencer.
+const clientBuffer = 1024
+
+// newGateway returns a gateway adding orders to ex, and starts its
+// sequencer.
+func newGateway(ex *Exchange) *gateway {
+	return &gateway{
+		sequencer: newSequencer(ex),
+		owners:    map[OrderNumber]*client{},
+	}
+}
+
+// newSequencer returns a sequencer for ex, and starts running requests.
+//
+// The sequencer follows the events of ex, after passing them on to any
+// events function set before, such as a journal.
+func newSequencer(ex *Exchange) *sequencer {
+	s := &sequencer{
+		ex:       ex,
+		requests: make(chan request),
+	}
+	events := ex.events
+	ex.events = func(event string) {
+		if events != nil {
+			events(event)
+		}
+		name, id, _ := strings.Cut(event, " ")
+		n, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return
+		}
+		switch name {
+		case "cancelled":
+			s.cancelled = append(s.cancelled, OrderNumber(n))
+		case "triggered":
+			s.triggered = append(s.triggered, OrderNumber(n))
+		}
+	}
+	go s.sequence()
+	return s
+}
+
+// serve accepts clients on l until it is closed, passing each to read
+// in a goroutine of its own.
+func (s *sequencer) serve(l net.Listener, read func(c *client)) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		c := &client{conn: conn, out: make(chan string, clientBuffer)}
+		go c.write()
+		go read(c)
+	}
+}
+
+// sequence runs the requests from all clients, one at a time, until it
+// is stopped.
+func (s *sequencer) sequence() {
+	for req := range s.requests {
+		if req.closing {
+			req.from.closed = true
+			close(req.from.out)
+			continue
+		}
+		req.run()
+		if req.from == nil {
+			return
+		}
+	}
+}
+
+// stop stops the sequencer, once the request it is running is done. No
+// more orders are added to the Exchange afterwards.
+func (s *sequencer) stop() {
+	done := make(chan struct{})
+	s.requests <- request{run: func() { close(done) }}
+	<-done
+}
+
+// serveOrders accepts orders from clients on l, with the FIX acceptor if
+// fix is set or with the gateway otherwise, until l is closed. It stops
+// adding orders to ex before it returns.
+func serveOrders(ex *Exchange, l net.Listener, fix bool) error {
+	var err error
+	if fix {
+		a := newFIXAcceptor(ex)
+		err = a.serve(l)
+		a.stop()
+	} else {
+		g := newGateway(ex)
+		err = g.serve(l)
+		g.stop()
+	}
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+// serve accepts clients on l until it is closed.
+func (g *gateway) serve(l net.Listener) error {
+	return g.sequencer.serve(l, g.read)
+}
+
+// read passes the lines from c to the sequencer, until c disconnects.
+func (g *gateway) read(c *client) {
+	scanner := bufio.NewScanner(c.conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		g.requests <- request{from: c, run: func() { g.handle(c, line) }}
+	}
+	g.requests <- request{from: c, closing: true}
+}
+
+// write writes the messages for c, until out is closed.
+func (c *client) write() {
+	w := bufio.NewWriter(c.conn)
+	for msg := range c.out {
+		w.WriteString(msg)
+		// Only flush when no more messages are waiting, so that the
+		// reports for an order are written together.
+		if len(c.out) == 0 && w.Flush() != nil {
+			c.conn.Close()
+		}
+	}
+	c.conn.Close()
+}
+
+// send queues a line to be written to c.
+func (c *client) send(format string, a ...interface{}) {
+	c.queue(fmt.Sprintf(format, a...) + "\n")
+}
+
+// queue queues msg to be written to c.
+//
+// A client that is too slow to keep up is disconnected.
+func (c *client) queue(msg string) {
+	if c.closed {
+		return
+	}
+	select {
+	case c.out <- msg:
+	default:
+		c.conn.Close()
+	}
+}
+
+// handle adds the order in line from c to the Exchange, and sends the
+// results to the clients concerned.
+func (g *gateway) handle(c *client, line string) {
+	order, err := ParseOrder(line)
+	if err != nil {
+		c.send("error %v", err)
+		return
+	}
+	// Clients may only cancel or modify their own orders.
+	target := order.ToCancel
+	if order.Type == Modify {
+		target = order.ToModify
+	}
+	if target != 0 && g.owners[target] != c {
+		c.send("error no open order %v of yours", target)
+		return
+	}
+
+	for _, o := range g.ex.Expire(order.Time) {
+		if owner := g.owners[o.id]; owner != nil {
+			owner.send("%s", withSymbol(fmt.Sprintf("expire %v", o.id), o.Symbol))
+			delete(g.owners, o.id)
+		}
+	}
+	matches, err := g.ex.Add(order)
+	defer g.forget(c, order, target)
+	if r, ok := err.(*Reject); ok {
+		c.send("%s", r.Output())
+		return
+	} else if err != nil {
+		c.send("error %v", err)
+		return
+	}
+	c.send("ack %v", order.id)
+	if order.level != nil {
+		g.owners[order.id] = c
+	}
+	// remaining holds the Remaining units of each order after each
+	// match, which are only known for the last match of the order.
+	remaining := make([]map[*Order]Volume, len(matches))
+	left := map[*Order]Volume{}
+	for i := len(matches) - 1; i >= 0; i-- {
+		m := matches[i]
+		remaining[i] = map[*Order]Volume{}
+		for _, o := range []*Order{m.Taker, m.Maker} {
+			if _, ok := left[o]; !ok {
+				left[o] = o.Remaining
+			}
+			remaining[i][o] = left[o]
+			left[o] += m.Volume
+		}
+	}
+	for i, m := range matches {
+		for _, o := range []*Order{m.Taker, m.Maker} {
+			owner := g.owners[o.id]
+			if o == order {
+				owner = c
+			}
+			if owner != nil {
+				owner.send("%s", withSymbol(fmt.Sprintf("fill %v %v %v %v", o.id, m.Volume, m.Price, remaining[i][o]), o.Symbol))
+			}
+			if o.level == nil {
+				// The order can no longer execute.
+				delete(g.owners, o.id)
+			}
+		}
+	}
+}
+
+// forget tells the owners of the orders cancelled by adding order from
+// c that they were, unless order is a Cancel for them. It then forgets
+// the owners of target and of the cancelled and triggered orders that no
+// longer rest in the books.
+func (g *gateway) forget(c *client, order *Order, target OrderNumber) {
+	for _, id := range g.cancelled {
+		owner := g.owners[id]
+		if id == order.id {
+			owner = c
+		}
+		if owner != nil && !(order.Type == Cancel && id == target) {
+			owner.send("%s", withSymbol(fmt.Sprintf("cancel %v", id), order.Symbol))
+		}
+	}
+	for _, id := range append(append(g.triggered, g.cancelled...), target) {
+		if g.ex.bookOf(id) == nil {
+			delete(g.owners, id)
+		}
+	}
+	g.cancelled, g.triggered = nil, nil
+}
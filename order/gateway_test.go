@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// startGateway starts a gateway for a new Exchange on a local port, and
+// returns its address.
+func startGateway(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go newGateway(newExchange()).serve(l)
+	return l.Addr().String()
+}
+
+// testClient is a connection to a gateway.
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialGateway(t *testing.T, addr string) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t, conn, bufio.NewReader(conn)}
+}
+
+// send sends line to the gateway, and returns the next n lines it sends
+// back.
+func (c *testClient) send(line string, n int) []string {
+	if _, err := fmt.Fprintln(c.conn, line); err != nil {
+		c.t.Errorf("failed to send %q: %v", line, err)
+		return nil
+	}
+	return c.read(n)
+}
+
+// read returns the next n lines from the gateway.
+func (c *testClient) read(n int) []string {
+	lines := []string{}
+	for len(lines) < n {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Errorf("failed to read: %v", err)
+			break
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+	return lines
+}
+
+func TestGateway(t *testing.T) {
+	addr := startGateway(t)
+	alice, bob := dialGateway(t, addr), dialGateway(t, addr)
+
+	steps := []struct {
+		c     *testClient
+		in    string
+		want  []string
+		other []string
+	}{
+		{alice, "limit buy 10 99.00", []string{"ack 1"}, nil},
+		{bob, "limit sell 4 98.00 sym=AAPL", []string{"ack 2"}, nil},
+		{bob, "limit sell 4 98.00", []string{"ack 3", "fill 3 4 99.00 0"}, []string{"fill 1 4 99.00 6"}},
+		{bob, "cancel na 1 0", []string{"error no open order 1 of yours"}, nil},
+		{bob, "limit buy 0 99.00", []string{`error invalid volume "0" in order "limit buy 0 99.00"`}, nil},
+		{alice, "modify na 2 99.00 5", []string{"error no open order 2 of yours"}, nil},
+		{bob, "modify na 2 98.00 2", []string{"ack 4"}, nil},
+		{alice, "market buy 3 0 sym=AAPL", []string{"ack 5", "fill 5 2 98.00 1 AAPL"}, []string{"fill 2 2 98.00 0 AAPL"}},
+		{bob, "limit sell 1 99.00 post", []string{"reject 6 post-only order would match"}, nil},
+		{bob, "limit sell 10 99.00 fok", []string{"reject 7 fill-or-kill order can't be filled"}, nil},
+		{alice, "cancel na 1 0", []string{"ack 8"}, nil},
+		{alice, "cancel na 1 0", []string{"error no open order 1 of yours"}, nil},
+	}
+	for _, step := range steps {
+		got := step.c.send(step.in, len(step.want))
+		if strings.Join(got, "\n") != strings.Join(step.want, "\n") {
+			t.Errorf("%q: got %q; want %q", step.in, got, step.want)
+		}
+		other := alice
+		if step.c == alice {
+			other = bob
+		}
+		if got := other.read(len(step.other)); strings.Join(got, "\n") != strings.Join(step.other, "\n") {
+			t.Errorf("%q: got %q for other client; want %q", step.in, got, step.other)
+		}
+	}
+}
+
+func TestGateway_parallel(t *testing.T) {
+	const clients, orders = 8, 100
+	addr := startGateway(t)
+	conns := make([]*testClient, clients)
+	for i := range conns {
+		conns[i] = dialGateway(t, addr)
+	}
+
+	var wg sync.WaitGroup
+	acked := make([]map[string]bool, clients)
+	filled := make([]int, clients)
+	for i, c := range conns {
+		wg.Add(1)
+		go func(i int, c *testClient) {
+			defer wg.Done()
+			side := "buy"
+			if i%2 == 1 {
+				side = "sell"
+			}
+			acked[i] = map[string]bool{}
+			w := bufio.NewWriter(c.conn)
+			for j := 0; j < orders; j++ {
+				fmt.Fprintf(w, "limit %s 1 100.00\n", side)
+			}
+			fmt.Fprintln(w, "sync")
+			if err := w.Flush(); err != nil {
+				t.Errorf("client %d: failed to send: %v", i, err)
+				return
+			}
+			for _, line := range c.sync() {
+				fields := strings.Fields(line)
+				switch fields[0] {
+				case "ack":
+					acked[i][fields[1]] = true
+				case "fill":
+					if !acked[i][fields[1]] {
+						t.Errorf("client %d: got %q for an order it didn't send", i, line)
+					}
+					filled[i]++
+				default:
+					t.Errorf("client %d: got unexpected %q", i, line)
+				}
+			}
+		}(i, c)
+	}
+	wg.Wait()
+
+	// All orders must get an ack, and have a unique number.
+	ids := map[string]bool{}
+	for i := range conns {
+		if len(acked[i]) != orders {
+			t.Errorf("client %d: got %d acks; want %d", i, len(acked[i]), orders)
+		}
+		for id := range acked[i] {
+			if ids[id] {
+				t.Errorf("got order %s acked twice", id)
+			}
+			ids[id] = true
+		}
+	}
+
+	// Fills for resting orders may be sent after the sync line of a
+	// client, so count them once all clients are done.
+	total := 0
+	for i, c := range conns {
+		fmt.Fprintln(c.conn, "sync")
+		total += filled[i] + len(c.sync())
+	}
+	if total != clients*orders {
+		t.Errorf("got %d fills; want %d", total, clients*orders)
+	}
+}
+
+// sync returns the lines that the gateway sends to c before the error for
+// a "sync" line, which comes after the reports for all orders sent
+// before it.
+func (c *testClient) sync() []string {
+	lines := []string{}
+	for {
+		line := c.read(1)
+		if len(line) == 0 || strings.HasPrefix(line[0], "error ") {
+			return lines
+		}
+		lines = append(lines, line[0])
+	}
+}
+
+// received returns the lines queued for c.
+func (c *client) received() []string {
+	lines := []string{}
+	for len(c.out) > 0 {
+		lines = append(lines, strings.TrimSuffix(<-c.out, "\n"))
+	}
+	return lines
+}
+
+func TestGateway_cancelled(t *testing.T) {
+	ex := newExchange()
+	ex.stp = CancelOldest
+	g := newGateway(ex)
+	alice := &client{out: make(chan string, clientBuffer)}
+	bob := &client{out: make(chan string, clientBuffer)}
+
+	steps := []struct {
+		c     *client
+		in    string
+		want  []string
+		other []string
+	}{
+		{alice, "limit sell 5 100.00 acct=A", []string{"ack 1"}, nil},
+		{bob, "limit sell 5 100.00 acct=B sym=AAPL", []string{"ack 2"}, nil},
+		{bob, "limit sell 5 100.00 acct=B", []string{"ack 3"}, nil},
+		// Self-trade prevention cancels order 1.
+		{alice, "limit buy 7 100.00 acct=A", []string{"ack 4", "fill 4 5 100.00 2", "cancel 1"}, []string{"fill 3 5 100.00 0"}},
+		{bob, "limit sell 1 101.00", []string{"ack 5"}, nil},
+		{alice, "limit buy 1 99.00 post", []string{"ack 6"}, nil},
+		// The modified post-only order would match, so it is cancelled.
+		{alice, "modify na 6 101.00 1", []string{"ack 7", "cancel 6"}, nil},
+		{bob, "cancel na 2 0.00", []string{"ack 8"}, nil},
+		{bob, "stoplimit buy 3 100.00 100.00 fok", []string{"ack 9"}, nil},
+		// Order 9 is triggered, and can't be filled.
+		{alice, "limit sell 1 100.00", []string{"ack 10", "fill 10 1 100.00 0", "fill 4 1 100.00 1"}, []string{"cancel 9"}},
+	}
+	for _, step := range steps {
+		g.handle(step.c, step.in)
+		if got := step.c.received(); strings.Join(got, "\n") != strings.Join(step.want, "\n") {
+			t.Errorf("%q: got %q; want %q", step.in, got, step.want)
+		}
+		other := alice
+		if step.c == alice {
+			other = bob
+		}
+		if got := other.received(); strings.Join(got, "\n") != strings.Join(step.other, "\n") {
+			t.Errorf("%q: got %q for other client; want %q", step.in, got, step.other)
+		}
+	}
+	if len(g.owners) != 2 || g.owners[4] != alice || g.owners[5] != bob {
+		t.Errorf("got owners %v; want order 4 of alice and 5 of bob", g.owners)
+	}
+}
+
+func TestServeOrders(t *testing.T) {
+	for _, fix := range []bool{false, true} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex := newExchange()
+		served := make(chan error)
+		go func() { served <- serveOrders(ex, l, fix) }()
+		if fix {
+			dialFIX(t, l.Addr().String()).send("35=D|11=a1|54=1|38=1|40=2|44=99", 1)
+		} else {
+			dialGateway(t, l.Addr().String()).send("limit buy 1 99.00", 1)
+		}
+		l.Close()
+		if err := <-served; err != nil {
+			t.Errorf("fix %v: serveOrders() got error %v after the listener closed", fix, err)
+		}
+		if ex.bookOf(1) == nil {
+			t.Errorf("fix %v: got order 1 not resting", fix)
+		}
+	}
+}
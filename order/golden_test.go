@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "If set, rewrite the .golden files in testdata with the current output")
+
+// diffLines returns a line-by-line comparison of got and want, marking
+// lines only in want with "-" and lines only in got with "+".
+func diffLines(got, want string) string {
+	g := strings.Split(strings.TrimSuffix(got, "\n"), "\n")
+	w := strings.Split(strings.TrimSuffix(want, "\n"), "\n")
+	// lcs[i][j] is the length of the longest common subsequence of
+	// g[i:] and w[j:].
+	lcs := make([][]int, len(g)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(w)+1)
+	}
+	for i := len(g) - 1; i >= 0; i-- {
+		for j := len(w) - 1; j >= 0; j-- {
+			if g[i] == w[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var b strings.Builder
+	i, j := 0, 0
+	for i < len(g) || j < len(w) {
+		switch {
+		case i < len(g) && j < len(w) && g[i] == w[j]:
+			fmt.Fprintf(&b, "  %s\n", g[i])
+			i++
+			j++
+		case j < len(w) && (i == len(g) || lcs[i][j+1] >= lcs[i+1][j]):
+			fmt.Fprintf(&b, "- %s\n", w[j])
+			j++
+		default:
+			fmt.Fprintf(&b, "+ %s\n", g[i])
+			i++
+		}
+	}
+	return b.String()
+}
+
+// TestScenarios feeds each testdata/*.txt scenario through the order
+// book, and compares the output and final positions to the matching
+// .golden file.
+//
+// Run with -update to regenerate the .golden files.
+func TestScenarios(t *testing.T) {
+	scenarios, err := filepath.Glob(filepath.Join("testdata", "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scenarios) == 0 {
+		t.Fatal("found no scenarios in testdata")
+	}
+	for _, scenario := range scenarios {
+		name := strings.TrimSuffix(filepath.Base(scenario), ".txt")
+		t.Run(name, func(t *testing.T) {
+			in, err := os.ReadFile(scenario)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ex := newExchange()
+			w := &bytes.Buffer{}
+			if err := run(ex, bytes.NewReader(in), w, &bytes.Buffer{}, true); err != nil {
+				t.Fatalf("run() got error %v", err)
+			}
+			ex.writePositions(w)
+			got := w.String()
+
+			golden := strings.TrimSuffix(scenario, ".txt") + ".golden"
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("output differs from %s (-want +got):\n%s", golden, diffLines(got, string(want)))
+			}
+		})
+	}
+}
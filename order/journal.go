@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// journal is a write-ahead log of the events of an Exchange.
+//
+// Each record in the journal is a line holding the CRC-32 checksum of an
+// event in hex, followed by a space and the event itself:
+//
+//	8fd3f1e9 order limit buy 10 99.00
+//	0f43ab48 match 4 3 3 100.50
+//
+// Every Order is recorded before it is added, followed by the changes it
+// caused in the books. So are the "auction" and "uncross" commands, and
+// orders expiring, as "expire 3". The first record holds the tick size,
+// followed by the settings of the Exchange that change how orders
+// execute, in the syntax of their flags, as "tick 0.01 stp=cancel-newest
+// max_size=100". Settings left at their default are left out.
+type journal struct {
+	f *os.File
+}
+
+var (
+	// errCorrupt is the error for journals with invalid records before
+	// the last one.
+	errCorrupt = errors.New("corrupt journal")
+	// errSettings is the error for journals written with other settings
+	// than those of the Exchange they are replayed to.
+	errSettings = errors.New("journal written with other settings")
+)
+
+// tickEvent returns the event recording the current tick size.
+func tickEvent() string {
+	return "tick " + Price(1).String()
+}
+
+// headerEvent returns the event for the first record of a journal of ex,
+// which holds the tick size and the settings of ex.
+func headerEvent(ex *Exchange) string {
+	event := tickEvent()
+	if ex.stp != AllowSelfTrade {
+		event += " stp=" + ex.stp.String()
+	}
+	for _, c := range ex.risk {
+		switch c := c.(type) {
+		case MaxOrderSize:
+			event += fmt.Sprintf(" max_size=%v", c.Volume)
+		case MaxNotional:
+			event += fmt.Sprintf(" max_notional=%v", c.Notional)
+		case PriceBand:
+			event += fmt.Sprintf(" price_band=%v", c.Percent)
+		case PositionLimit:
+			event += fmt.Sprintf(" max_position=%v", c.Limit)
+		default:
+			event += fmt.Sprintf(" risk=%T%+v", c, c)
+		}
+	}
+	for _, symbol := range sortedKeys(ex.policies) {
+		name := symbol
+		if name == "" {
+			name = "-"
+		}
+		switch p := ex.policies[symbol].(type) {
+		case ProRata:
+			event += fmt.Sprintf(" pro_rata=%s min_allocation=%v", name, p.MinAllocation)
+		default:
+			event += fmt.Sprintf(" policy=%s:%T%+v", name, p, p)
+		}
+	}
+	return event
+}
+
+// journalRecord returns the journal record for event.
+func journalRecord(event string) string {
+	return fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE([]byte(event)), event)
+}
+
+// record appends event to the journal.
+//
+// Since the journal must hold all changes to the books, record exits if
+// event can't be written.
+func (j *journal) record(event string) {
+	_, err := io.WriteString(j.f, journalRecord(event))
+	if err != nil {
+		log.Fatalf("Failed to write journal: %v\n", err)
+	}
+}
+
+// Close closes the journal file.
+func (j *journal) Close() error {
+	return j.f.Close()
+}
+
+// openJournal opens the journal at path, creating it if needed, and
+// replays it to ex. All later events of ex are recorded in the journal.
+//
+// A truncated record at the end of the journal, e.g. from a crash while
+// it was written, is dropped.
+func openJournal(path string, ex *Exchange) (*journal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	size, missing, err := replayJournal(f, ex, io.Discard)
+	if err == nil {
+		err = f.Truncate(size)
+	}
+	if err == nil {
+		_, err = f.Seek(size, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to open journal %s: %w", path, err)
+	}
+
+	j := &journal{f}
+	if size == 0 {
+		j.record(headerEvent(ex))
+	}
+	// Changes caused by the last order before a crash may not have made
+	// it to the journal.
+	for _, event := range missing {
+		j.record(event)
+	}
+	ex.events = j.record
+	return j, nil
+}
+
+// readRecord returns the event of the next record in r, and its size.
+//
+// io.EOF is returned at the end of r. A truncated or invalid record at
+// the end of r is also treated as the end, while an invalid record
+// followed by more records gives errCorrupt.
+func readRecord(r *bufio.Reader) (string, int, error) {
+	line, err := r.ReadString('\n')
+	if err == io.EOF {
+		// A record without newline is truncated.
+		return "", 0, io.EOF
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	_, event, _ := strings.Cut(strings.TrimSuffix(line, "\n"), " ")
+	if line == journalRecord(event) {
+		return event, len(line), nil
+	}
+	if _, err := r.Peek(1); err == io.EOF {
+		return "", 0, io.EOF
+	}
+	return "", 0, fmt.Errorf("%w: bad record %q", errCorrupt, line)
+}
+
+// replayJournal rebuilds ex from the journal in r, writing the output
+// for the replayed orders to w.
+//
+// The changes recorded for each Order are checked against the changes
+// caused by adding it again. replayJournal returns the size of the valid
+// part of the journal, and any changes caused by the last Order that are
+// missing from it.
+func replayJournal(r io.Reader, ex *Exchange, w io.Writer) (int64, []string, error) {
+	br := bufio.NewReader(r)
+	// pending holds the changes caused by the last Order that have not
+	// been found in the journal yet.
+	pending := []string{}
+	ex.events = func(event string) {
+		pending = append(pending, event)
+	}
+	defer func() { ex.events = nil }()
+
+	size := int64(0)
+	for n := 1; ; n++ {
+		event, recsize, err := readRecord(br)
+		if err == io.EOF {
+			return size, pending, nil
+		}
+		if err != nil {
+			return size, nil, fmt.Errorf("record %d: %w", n, err)
+		}
+		size += int64(recsize)
+
+		if n == 1 {
+			if !strings.HasPrefix(event+" ", tickEvent()+" ") {
+				return size, nil, fmt.Errorf("%w: got %q; want %q", errCorrupt, event, tickEvent())
+			}
+			if event != headerEvent(ex) {
+				return size, nil, fmt.Errorf("%w: got %q; want %q", errSettings, event, headerEvent(ex))
+			}
+			continue
+		}
+		if strings.HasPrefix(event, "order ") {
+			if len(pending) > 0 {
+				return size, nil, fmt.Errorf("record %d: %w: missing %q", n, errCorrupt, pending)
+			}
+			order, err := ParseOrder(strings.TrimPrefix(event, "order "))
+			if err != nil {
+				return size, nil, fmt.Errorf("record %d: %w: %v", n, errCorrupt, err)
+			}
+			matches, err := ex.Add(order)
+			if err := output(w, matches, err); err != nil {
+				return size, nil, fmt.Errorf("record %d: %w", n, err)
+			}
+		} else if id, ok := strings.CutPrefix(event, "expire "); ok {
+			if len(pending) > 0 {
+				return size, nil, fmt.Errorf("record %d: %w: missing %q", n, errCorrupt, pending)
+			}
+			number, err := strconv.ParseInt(id, 10, 64)
+			if err != nil {
+				return size, nil, fmt.Errorf("record %d: %w: %v", n, errCorrupt, err)
+			}
+			order := ex.expireOrder(OrderNumber(number))
+			if order == nil {
+				return size, nil, fmt.Errorf("record %d: %w: no open order %v to expire", n, errCorrupt, id)
+			}
+			writeExpired(w, []*Order{order})
+		} else if name, _, _ := strings.Cut(event, " "); name == "auction" || name == "uncross" {
+			if len(pending) > 0 {
+				return size, nil, fmt.Errorf("record %d: %w: missing %q", n, errCorrupt, pending)
+			}
+			if _, err := runCommand(ex, event, w); err != nil {
+				return size, nil, fmt.Errorf("record %d: %w: %v", n, errCorrupt, err)
+			}
+		}
+		if len(pending) == 0 || pending[0] != event {
+			return size, nil, fmt.Errorf("record %d: %w: replay diverges at %q, got %q", n, errCorrupt, event, pending)
+		}
+		pending = pending[1:]
+	}
+}
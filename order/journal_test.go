@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runJournaled runs the orders in input with a journal at path, and
+// returns the output.
+func runJournaled(t *testing.T, path string, input []byte) string {
+	ex := newExchange()
+	j, err := openJournal(path, ex)
+	if err != nil {
+		t.Fatalf("openJournal() got error %v", err)
+	}
+	defer j.Close()
+	w := &bytes.Buffer{}
+	if err := run(ex, bytes.NewReader(input), w, &bytes.Buffer{}, true); err != nil {
+		t.Fatalf("run() got error %v", err)
+	}
+	return w.String()
+}
+
+// replayed returns the output of replaying the journal at path.
+func replayed(t *testing.T, path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := &bytes.Buffer{}
+	if _, _, err := replayJournal(f, newExchange(), w); err != nil {
+		t.Fatalf("replayJournal() got error %v", err)
+	}
+	return w.String()
+}
+
+func TestJournal_Replay(t *testing.T) {
+	scenarios, err := filepath.Glob(filepath.Join("testdata", "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, scenario := range scenarios {
+		t.Run(filepath.Base(scenario), func(t *testing.T) {
+			in, err := os.ReadFile(scenario)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(t.TempDir(), "journal")
+			// Run the scenario in two halves, restoring the books from the
+			// journal in between.
+			lines := strings.SplitAfter(string(in), "\n")
+			half := len(lines) / 2
+			want := runJournaled(t, path, []byte(strings.Join(lines[:half], "")))
+			want += runJournaled(t, path, []byte(strings.Join(lines[half:], "")))
+
+			if got := replayed(t, path); got != want {
+				t.Errorf("replay differs (-want +got):\n%s", diffLines(got, want))
+			}
+		})
+	}
+}
+
+func TestJournal_Truncated(t *testing.T) {
+	in, err := os.ReadFile("input.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "journal")
+	want := runJournaled(t, path, in)
+
+	journal, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Chop off the last match, and the end of the one before it.
+	lines := strings.SplitAfter(string(journal), "\n")
+	truncated := strings.Join(lines[:len(lines)-3], "") + lines[len(lines)-3][:10]
+	if err := os.WriteFile(path, []byte(truncated), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening the journal restores the missing records.
+	runJournaled(t, path, nil)
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(journal) {
+		t.Errorf("got journal after reopening (-want +got):\n%s", diffLines(string(got), string(journal)))
+	}
+	if got := replayed(t, path); got != want {
+		t.Errorf("replay differs (-want +got):\n%s", diffLines(got, want))
+	}
+}
+
+func TestJournal_Corrupt(t *testing.T) {
+	in, err := os.ReadFile("input.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "journal")
+	runJournaled(t, path, in)
+	journal, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		desc string
+		from string
+		to   string
+	}{
+		{"bad checksum", "order limit buy 15 100.00", "order limit buy 16 100.00"},
+		{"tick size", journalRecord("tick 0.01"), journalRecord("tick 0.05")},
+		{"missing match", journalRecord("match 4 3 3 100.50"), ""},
+		{"extra match", journalRecord("match 4 3 3 100.50"), journalRecord("match 4 3 3 100.50") + journalRecord("match 4 1 1 99.00")},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			corrupt := strings.Replace(string(journal), tc.from, tc.to, 1)
+			if corrupt == string(journal) {
+				t.Fatalf("found no %q in journal", tc.from)
+			}
+			_, _, err := replayJournal(strings.NewReader(corrupt), newExchange(), &bytes.Buffer{})
+			if !errors.Is(err, errCorrupt) {
+				t.Errorf("replayJournal() got error %v; want %v", err, errCorrupt)
+			}
+		})
+	}
+}
+
+func TestJournal_Settings(t *testing.T) {
+	configured := func() *Exchange {
+		ex := newExchange()
+		ex.stp = CancelNewest
+		ex.risk = []RiskCheck{MaxOrderSize{100}, MaxNotional{100000}}
+		ex.policies["AAPL"] = ProRata{2}
+		return ex
+	}
+	path := filepath.Join(t.TempDir(), "journal")
+	j, err := openJournal(path, configured())
+	if err != nil {
+		t.Fatalf("openJournal() got error %v", err)
+	}
+	j.Close()
+	journal, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := journalRecord("tick 0.01 stp=cancel-newest max_size=100 max_notional=1000.00 pro_rata=AAPL min_allocation=2")
+	if string(journal) != want {
+		t.Errorf("got journal %q; want %q", journal, want)
+	}
+
+	if _, _, err := replayJournal(strings.NewReader(want), configured(), &bytes.Buffer{}); err != nil {
+		t.Errorf("replayJournal() got error %v", err)
+	}
+	if _, _, err := replayJournal(strings.NewReader(want), newExchange(), &bytes.Buffer{}); !errors.Is(err, errSettings) {
+		t.Errorf("replayJournal() with other settings got error %v; want %v", err, errSettings)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+type (
+	// MarketEvent is an event in the market data feed of an Exchange,
+	// i.e. a Trade, Quote or Bar.
+	MarketEvent interface {
+		// Output returns the output format to emit for the event.
+		Output() string
+		// kind returns the name of the event type, e.g. "trade".
+		kind() string
+	}
+
+	// Trade is an execution on the trade tape of an Exchange.
+	Trade struct {
+		// Seq is the sequence number of the Trade, counting from 1 across
+		// all symbols of the Exchange.
+		Seq    uint64 `json:"seq"`
+		Time   int64  `json:"time"`
+		Symbol string `json:"symbol"`
+		// Side is the side of the taker, which initiated the Trade.
+		Side   OrderSide   `json:"side"`
+		Taker  OrderNumber `json:"taker"`
+		Maker  OrderNumber `json:"maker"`
+		Volume Volume      `json:"volume"`
+		Price  Price       `json:"price"`
+	}
+
+	// Quote is the best bid and offer of a book.
+	//
+	// A side of the book without orders has zero price and volume.
+	Quote struct {
+		Time      int64  `json:"time"`
+		Symbol    string `json:"symbol"`
+		Bid       Price  `json:"bid"`
+		BidVolume Volume `json:"bid_volume"`
+		Ask       Price  `json:"ask"`
+		AskVolume Volume `json:"ask_volume"`
+	}
+
+	// Bar is the open, high, low and close price and the volume traded in
+	// a book during an interval.
+	Bar struct {
+		Symbol string `json:"symbol"`
+		// Start is the beginning of the interval, in seconds since the
+		// Unix epoch.
+		Start  int64  `json:"start"`
+		Open   Price  `json:"open"`
+		High   Price  `json:"high"`
+		Low    Price  `json:"low"`
+		Close  Price  `json:"close"`
+		Volume Volume `json:"volume"`
+	}
+
+	// MarketData derives the market data feed of an Exchange from the
+	// orders added to it.
+	//
+	// The time of events is taken from the Time of the orders, and never
+	// goes backwards; orders without a Time happen at the time of the
+	// previous order.
+	MarketData struct {
+		// handler is called with each event.
+		handler func(MarketEvent)
+		// interval is the length of bars in seconds, or 0 for no bars.
+		interval int64
+		// now is the current time.
+		now int64
+		// seq is the sequence number of the last Trade.
+		seq uint64
+		// quotes holds the last Quote of each symbol.
+		quotes map[string]Quote
+		// bars holds the open Bar of each symbol which has traded in the
+		// current interval.
+		bars map[string]*Bar
+	}
+)
+
+// NewMarketData returns a MarketData that calls handler with each event,
+// building bars of interval seconds, or no bars if interval is 0.
+func NewMarketData(interval int64, handler func(MarketEvent)) *MarketData {
+	return &MarketData{
+		handler:  handler,
+		interval: interval,
+		quotes:   map[string]Quote{},
+		bars:     map[string]*Bar{},
+	}
+}
+
+func (t Trade) kind() string { return "trade" }
+func (q Quote) kind() string { return "bbo" }
+func (b Bar) kind() string   { return "bar" }
+
+// withSymbol returns out followed by symbol, unless it is the default
+// instrument.
+func withSymbol(out, symbol string) string {
+	if symbol != "" {
+		out += " " + symbol
+	}
+	return out
+}
+
+// Output returns the output format to emit for the Trade, i.e.
+// "trade SEQ TIME SIDE VOLUME PRICE [SYMBOL]".
+func (t Trade) Output() string {
+	return withSymbol(fmt.Sprintf("trade %v %v %v %v %v", t.Seq, t.Time, t.Side, t.Volume, t.Price), t.Symbol)
+}
+
+// Output returns the output format to emit for the Quote, i.e.
+// "bbo TIME BID BIDVOLUME ASK ASKVOLUME [SYMBOL]", with "-" as the price
+// of empty sides.
+func (q Quote) Output() string {
+	price := func(p Price, v Volume) string {
+		if v == 0 {
+			return "-"
+		}
+		return p.String()
+	}
+	return withSymbol(fmt.Sprintf("bbo %v %v %v %v %v", q.Time, price(q.Bid, q.BidVolume), q.BidVolume, price(q.Ask, q.AskVolume), q.AskVolume), q.Symbol)
+}
+
+// Output returns the output format to emit for the Bar, i.e.
+// "bar START OPEN HIGH LOW CLOSE VOLUME [SYMBOL]".
+func (b Bar) Output() string {
+	return withSymbol(fmt.Sprintf("bar %v %v %v %v %v %v", b.Start, b.Open, b.High, b.Low, b.Close, b.Volume), b.Symbol)
+}
+
+// MarshalText returns the name of the OrderSide, so that it is
+// represented as e.g. "buy" in JSON.
+func (oside OrderSide) MarshalText() ([]byte, error) {
+	return []byte(oside.String()), nil
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// lineWriter returns a handler writing the Output of each event to w.
+func lineWriter(w io.Writer) func(MarketEvent) {
+	return func(e MarketEvent) {
+		fmt.Fprintln(w, e.Output())
+	}
+}
+
+// jsonWriter returns a handler writing each event to w as a line of
+// JSON, like {"type":"trade","event":{...}}.
+func jsonWriter(w io.Writer) func(MarketEvent) {
+	enc := json.NewEncoder(w)
+	return func(e MarketEvent) {
+		// The events only hold numbers and strings, so they can always
+		// be encoded.
+		enc.Encode(struct {
+			Type  string      `json:"type"`
+			Event MarketEvent `json:"event"`
+		}{e.kind(), e})
+	}
+}
+
+// openMarketData returns a MarketData writing its events to a new file
+// at path, in the given format, with bars of interval.
+//
+// The returned func emits the bars that are still open, and closes the
+// file.
+func openMarketData(path, format string, interval time.Duration) (*MarketData, func() error, error) {
+	if interval < 0 || interval%time.Second != 0 {
+		return nil, nil, fmt.Errorf("invalid bar interval %v: must be whole seconds", interval)
+	}
+	var writer func(io.Writer) func(MarketEvent)
+	switch format {
+	case "line":
+		writer = lineWriter
+	case "json":
+		writer = jsonWriter
+	default:
+		return nil, nil, fmt.Errorf("invalid market data format %q", format)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	w := bufio.NewWriter(f)
+	md := NewMarketData(int64(interval/time.Second), writer(w))
+	close := func() error {
+		md.Close()
+		err := w.Flush()
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write market data: %v", err)
+		}
+		return nil
+	}
+	return md, close, nil
+}
+
+// advance moves the clock to t, closing any bars that end by then.
+func (md *MarketData) advance(t int64) {
+	if t > md.now {
+		md.now = t
+	}
+	if md.interval == 0 {
+		return
+	}
+	start := md.now - md.now%md.interval
+	for _, symbol := range sortedKeys(md.bars) {
+		if bar := md.bars[symbol]; bar.Start < start {
+			md.handler(*bar)
+			delete(md.bars, symbol)
+		}
+	}
+}
+
+// trade records a Match in book on the trade tape and in the current bar.
+func (md *MarketData) trade(book *OrderBook, m *Match) {
+	md.seq++
+	md.handler(Trade{
+		Seq:    md.seq,
+		Time:   md.now,
+		Symbol: book.symbol,
+		Side:   m.Taker.Side,
+		Taker:  m.Taker.id,
+		Maker:  m.Maker.id,
+		Volume: m.Volume,
+		Price:  m.Price,
+	})
+	if md.interval == 0 {
+		return
+	}
+	bar, ok := md.bars[book.symbol]
+	if !ok {
+		bar = &Bar{
+			Symbol: book.symbol,
+			Start:  md.now - md.now%md.interval,
+			Open:   m.Price,
+			High:   m.Price,
+			Low:    m.Price,
+		}
+		md.bars[book.symbol] = bar
+	}
+	if m.Price > bar.High {
+		bar.High = m.Price
+	}
+	if m.Price < bar.Low {
+		bar.Low = m.Price
+	}
+	bar.Close = m.Price
+	bar.Volume += m.Volume
+}
+
+// quote emits the best bid and offer of book if they have changed.
+func (md *MarketData) quote(book *OrderBook) {
+	q := Quote{Symbol: book.symbol}
+	if level := book.buyOrders.best(); level != nil {
+		q.Bid, q.BidVolume = level.price, level.volume()
+	}
+	if level := book.sellOrders.best(); level != nil {
+		q.Ask, q.AskVolume = level.price, level.volume()
+	}
+	last := md.quotes[book.symbol]
+	q.Time = last.Time
+	if q == last {
+		return
+	}
+	q.Time = md.now
+	md.quotes[book.symbol] = q
+	md.handler(q)
+}
+
+// update emits the events for an Order added at time t to book, which
+// caused matches.
+//
+// Bars that ended before t are emitted first, followed by the trades and
+// then the new best bid and offer, if it changed.
+func (md *MarketData) update(book *OrderBook, t int64, matches Matches) {
+	md.advance(t)
+	for _, m := range matches {
+		md.trade(book, m)
+	}
+	md.quote(book)
+}
+
+// Close emits the bars that are still open, ordered by symbol.
+func (md *MarketData) Close() {
+	for _, symbol := range sortedKeys(md.bars) {
+		md.handler(*md.bars[symbol])
+		delete(md.bars, symbol)
+	}
+}
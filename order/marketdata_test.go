@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestMarketData(t *testing.T) {
+	ex := newExchange()
+	events := []MarketEvent{}
+	ex.marketData = NewMarketData(60, func(e MarketEvent) {
+		events = append(events, e)
+	})
+	in := strings.Join([]string{
+		"limit buy 10 99.00 time=100",
+		"limit sell 5 101.00 time=110",
+		"limit buy 5 99.00 time=115",
+		"market sell 12 0.00 time=130",
+		"limit sell 2 100.00 sym=AAPL",
+		"market buy 2 0.00 time=125 sym=AAPL",
+		"limit buy 1 98.00 time=190",
+		"market sell 1 0.00 time=240",
+	}, "\n")
+	if err := run(ex, strings.NewReader(in), &bytes.Buffer{}, &bytes.Buffer{}, true); err != nil {
+		t.Fatalf("run() got error %v", err)
+	}
+	ex.marketData.Close()
+
+	got := []string{}
+	for _, e := range events {
+		got = append(got, e.Output())
+	}
+	want := []string{
+		"bbo 100 99.00 10 - 0",
+		"bbo 110 99.00 10 101.00 5",
+		"bbo 115 99.00 15 101.00 5",
+		"trade 1 130 sell 10 99.00",
+		"trade 2 130 sell 2 99.00",
+		"bbo 130 99.00 3 101.00 5",
+		"bbo 130 - 0 100.00 2 AAPL",
+		// Time does not go backwards.
+		"trade 3 130 buy 2 100.00 AAPL",
+		"bbo 130 - 0 - 0 AAPL",
+		"bar 120 99.00 99.00 99.00 99.00 12",
+		"bar 120 100.00 100.00 100.00 100.00 2 AAPL",
+		"trade 4 240 sell 1 99.00",
+		"bbo 240 99.00 2 101.00 5",
+		"bar 240 99.00 99.00 99.00 99.00 1",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got events (-want +got):\n%s", diffLines(strings.Join(got, "\n"), strings.Join(want, "\n")))
+	}
+}
+
+func TestMarketData_JSON(t *testing.T) {
+	w := &bytes.Buffer{}
+	handler := jsonWriter(w)
+	handler(Trade{Seq: 1, Time: 60, Side: BuySide, Taker: 2, Maker: 1, Volume: 5, Price: 9950})
+	handler(Bar{Start: 60, Open: 9950, High: 9950, Low: 9950, Close: 9950, Volume: 5})
+
+	want := `{"type":"trade","event":{"seq":1,"time":60,"symbol":"","side":"buy","taker":2,"maker":1,"volume":5,"price":"99.50"}}
+{"type":"bar","event":{"symbol":"","start":60,"open":"99.50","high":"99.50","low":"99.50","close":"99.50","volume":5}}
+`
+	if got := w.String(); got != want {
+		t.Errorf("got %s; want %s", got, want)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(w.String()), "\n") {
+		if !json.Valid([]byte(line)) {
+			t.Errorf("got invalid JSON %q", line)
+		}
+	}
+}
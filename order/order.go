@@ -3,12 +3,20 @@ package main
 
 import (
 	"bufio"
+	"container/heap"
+	"container/list"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"os"
+	"os/signal"
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -16,8 +24,8 @@ type (
 	// OrderNumber is a unique number of an Order.
 	OrderNumber int64
 
-	// Price is a value in USD.
-	Price float64
+	// Price is a value in USD, as an integer number of ticks.
+	Price int64
 
 	// Volume is the amount of units being traded.
 	Volume uint64
@@ -28,16 +36,30 @@ type (
 	// OrderSide is the side of an order, i.e. "buy" or "sell".
 	OrderSide uint8
 
+	// TimeInForce is how long an order remains in effect.
+	TimeInForce uint8
+
+	// SelfTradePolicy is what happens when two orders of the same
+	// Account would match.
+	SelfTradePolicy uint8
+
 	// Order is a request to trade items under some conditions.
 	Order struct {
 		// The unique id of the Order.
 		id OrderNumber
+		// Symbol is the instrument to trade. Orders without a Symbol trade
+		// the default instrument.
+		Symbol string
+		// Account is the participant that the Order belongs to, if any.
+		Account string
 		// cancelled is true if the Order has been cancelled.
 		cancelled bool
 		// executed is true if the Order has been fully executed.
 		executed bool
 		// stopTriggered is true for stop orders that have been triggered.
 		stopTriggered bool
+		// modified is true if the Order has been changed by a Modify order.
+		modified bool
 		// Type is the kind of order, which determines when the order can
 		// execute.
 		Type OrderType
@@ -46,34 +68,90 @@ type (
 		// Limit is the price boundary of an order, where applicable. Semantics
 		// differ on OrderType.
 		Limit Price
-		// Volume is the number of units to trade for an order, where applicable.
+		// Volume is the number of units to trade for an order, where
+		// applicable. Volume is the original size of the order, and is not
+		// changed by executions.
 		Volume Volume
 		// Remaining is the number of units to trade that remains
 		// unexecuted in order, where applicable.
 		Remaining Volume
+		// StopPrice is the threshold of a StopLimit order.
+		StopPrice Price
 		// ToCancel is the OrderNumber of a previous order to cancel, where applicable.
 		ToCancel OrderNumber
+		// ToModify is the OrderNumber of a previous order to modify, where applicable.
+		ToModify OrderNumber
+		// TimeInForce is how long a Limit or stop order remains in effect.
+		TimeInForce TimeInForce
+		// PostOnly is true for Limit orders that may only add liquidity to
+		// the book; they are rejected if they would match right away.
+		PostOnly bool
+		// Peak is the number of units that an iceberg Limit or StopLimit
+		// order displays in the book at a time, or 0 to display all of
+		// them.
+		Peak Volume
+		// shown is the number of units of an iceberg order that are
+		// displayed, until they are executed and replenished from the
+		// rest of the order.
+		shown Volume
+		// Expiry is when a GoodForDay or GoodTillTime order expires, in
+		// seconds since the Unix epoch, or 0 if it doesn't.
+		Expiry int64
+		// queued is true once the Order is in the expiries of its book,
+		// which it stays in when it is modified, or triggered and rested.
+		queued bool
+		// Time is when the Order was submitted, in seconds since the Unix
+		// epoch, or 0 if the input did not say.
+		Time int64
+		// level is the price level the Order rests at, if any.
+		level *priceLevel
+		// elem is the position of the Order in the queue of level.
+		elem *list.Element
 	}
 
-	// orderTree is a representation of Order items for the orderbook.
-	//
-	// orderTree is a binary search tree that uses the price limit of orders as
-	// comparison key.
-	orderTree struct {
-		left, right *orderTree
-		item        *Order
-	}
-
-	// OrderBook holds all the orders.
+	// OrderBook holds all the orders for one instrument.
 	OrderBook struct {
 		// buyOrders holds the BuySide orders in the book.
-		buyOrders *orderTree
+		buyOrders *bookSide
 		// sellOrders holds the SellSide orders in the book.
-		sellOrders *orderTree
-		// stopOrders holds the stop orders in the book which are not yet triggered.
-		stopOrders *orderTree
-		nextOrder  OrderNumber
-		cancelled  map[OrderNumber]bool
+		sellOrders *bookSide
+		// buyStops holds the BuySide stop orders in the book which are not
+		// yet triggered, by threshold.
+		buyStops *bookSide
+		// sellStops holds the SellSide stop orders in the book which are not
+		// yet triggered, by threshold.
+		sellStops *bookSide
+		// orders holds all resting orders in the book by their number.
+		orders map[OrderNumber]*Order
+		// open holds the Remaining units of the resting orders of each
+		// Account on each side, including untriggered stop orders.
+		open map[openKey]Volume
+		// symbol is the instrument traded in the book.
+		symbol string
+		// auction is true while the book is in an auction, where orders
+		// rest without matching until the book is uncrossed.
+		auction bool
+		// last is the price of the last trade in the book, or 0 if there
+		// has been none.
+		last Price
+		// policy decides how incoming orders are shared among the
+		// resting orders at a price level.
+		policy MatchingPolicy
+		// stp is what happens when two orders of the same Account would
+		// match in the book.
+		stp SelfTradePolicy
+		// expiries holds the orders that have rested in the book with an
+		// Expiry.
+		expiries expiryQueue
+		// nextOrder is the number of the next Order added, which may be
+		// shared with other books.
+		nextOrder *OrderNumber
+		// resting, if set, holds the book that each resting order is in,
+		// by number, and is shared with other books.
+		resting map[OrderNumber]*OrderBook
+		// events, if set, is called with a description of each change to
+		// the book, such as "match 4 3 3 100.50" or "cancelled 2".
+		events func(event string)
 	}
 
 	// Match is a match between two orders.
@@ -90,6 +168,21 @@ type (
 
 	// Matches is several matches between pairs of orders.
 	Matches []*Match
+
+	// openKey identifies the resting orders of an Account on a side of
+	// an OrderBook.
+	openKey struct {
+		account string
+		side    OrderSide
+	}
+
+	// Reject is the error for an Order that the OrderBook refuses.
+	Reject struct {
+		// Order is the rejected Order.
+		Order *Order
+		// Reason describes why Order was rejected.
+		Reason string
+	}
 )
 
 const (
@@ -107,17 +200,44 @@ const (
 	// Stop is an Order to trigger when price reaches given threshold.
 	//
 	// A Stop Order effectively creates a Market Order once the threshold
-	// is reached.
+	// is reached by a trade. If several Stop orders trigger at the same
+	// time, the oldest executes first.
 	//
 	// Volume holds the number of units to trade.
 	//
-	// Limit holds the threshold which if price goes below it triggers a SellSide Order.
-	// Limit holds the threshold which if price goes above it triggers a BuySide Order.
+	// Limit holds the threshold which if price goes to or below it triggers a SellSide Order.
+	// Limit holds the threshold which if price goes to or above it triggers a BuySide Order.
 	Stop
 	// Cancel is an Order to cancel a previous Order.
 	//
 	// ToCancel holds the number of a previous order to cancel.
 	Cancel
+	// StopLimit is an Order to trigger when price reaches given threshold,
+	// like a Stop Order.
+	//
+	// A StopLimit Order creates a Limit Order once the threshold is
+	// reached by a trade.
+	//
+	// Volume holds the number of units to trade.
+	//
+	// StopPrice holds the threshold, as Limit does for a Stop Order.
+	//
+	// Limit holds the price limit of the Limit Order created.
+	StopLimit
+	// Modify is an Order to change the price and size of a previous
+	// Order that is still resting in the book.
+	//
+	// Reducing the size keeps the time priority of the previous Order,
+	// while changing its price or increasing its size loses it.
+	//
+	// ToModify holds the number of the previous order to modify.
+	//
+	// Limit holds the new price, which is the threshold for Stop orders
+	// and the limit for other orders.
+	//
+	// Volume holds the new number of units to trade, including any units
+	// already executed.
+	Modify
 
 	// UndefinedSide is a default value for Order types which have no side.
 	UndefinedSide OrderSide = iota + 1
@@ -127,24 +247,119 @@ const (
 	SellSide
 )
 
+const (
+	// GoodTillCancel orders rest in the book until executed or
+	// cancelled. It is the default TimeInForce.
+	GoodTillCancel TimeInForce = iota
+	// ImmediateOrCancel orders execute what they can right away, and the
+	// rest is cancelled.
+	ImmediateOrCancel
+	// FillOrKill orders either execute fully right away, or are
+	// cancelled without executing at all.
+	FillOrKill
+	// GoodForDay orders rest in the book until the end of the day they
+	// were submitted, in UTC, when they expire.
+	GoodForDay
+	// GoodTillTime orders rest in the book until their Expiry.
+	GoodTillTime
+)
+
+const (
+	// AllowSelfTrade lets orders of the same Account match each other. It
+	// is the default SelfTradePolicy.
+	AllowSelfTrade SelfTradePolicy = iota
+	// CancelNewest cancels the rest of the incoming order.
+	CancelNewest
+	// CancelOldest cancels the resting order, and the incoming order
+	// goes on to match the next one.
+	CancelOldest
+	// DecrementBoth reduces the size of both orders by the smaller of
+	// their remaining units, without a trade, and cancels any order
+	// left with no units.
+	DecrementBoth
+)
+
 var (
+	strict           = flag.Bool("strict", false, "If set, exit on the first invalid order line. If not set, invalid lines are reported on stderr and skipped")
+	tickSizeFlag     = flag.String("tick_size", "0.01", "Smallest price increment. Prices that aren't a multiple of it are rejected")
+	journalPath      = flag.String("journal", "", "If set, path of a journal that all orders and their effects are appended to. An existing journal is replayed on startup to restore the books")
+	snapshotPath     = flag.String("snapshot", "", "If set, path to write a JSON snapshot of all orders resting in the books to at the end of input")
+	marketDataPath   = flag.String("market_data", "", "If set, path to write market data to: trades, best bid and offer changes and OHLCV bars, timed by the time= option of orders")
+	marketDataFormat = flag.String("market_data_format", "line", "Format of -market_data, either \"line\" or \"json\"")
+	barInterval      = flag.Duration("bar_interval", time.Minute, "Length of the OHLCV bars in -market_data, in whole seconds, or 0 for no bars")
+	stpFlag          = flag.String("stp", "allow", "Self-trade prevention policy for orders of the same acct=: allow, cancel-newest, cancel-oldest or decrement")
+	maxSize          = flag.Uint64("max_size", 0, "If set, orders for more units are rejected")
+	maxNotional      = flag.String("max_notional", "", "If set, orders that could trade for more money are rejected")
+	priceBand        = flag.Int64("price_band", 0, "If set, orders priced more than this many percent away from the last trade are rejected")
+	maxPosition      = flag.Int64("max_position", 0, "If set, orders that could take the position of their acct= beyond this many units long or short are rejected")
+	proRata          = flag.String("pro_rata", "", "Comma-separated symbols whose books share fills at each price in proportion to order size, instead of oldest first; \"-\" is the default instrument")
+	minAllocation    = flag.Uint64("min_allocation", 0, "Smallest fill that -pro_rata books give an order from its share; smaller shares go to the oldest orders")
+	backtestPath     = flag.String("backtest", "", "If set, path of a .csv or .jsonl file of historical orders to replay with the -strategies, reporting the results of each instead of reading stdin")
+	strategyNames    = flag.String("strategies", "momentum", "Comma-separated built-in strategies to run in -backtest: momentum or maker")
+	latency          = flag.Duration("latency", 0, "Time that orders from -strategies take to reach the books in -backtest")
+	fixFlag          = flag.Bool("fix", false, "If set, -listen accepts FIX 4.4 NewOrderSingle, OrderCancelRequest and OrderCancelReplaceRequest messages instead of order lines, and sends execution reports back")
+	listen           = flag.String("listen", "", "If set, address such as \":9000\" to accept orders from TCP clients on, instead of reading them from stdin")
+	replay           = flag.Bool("replay", false, "If set, replay the -journal to stdout and exit")
+	verbosity        = flag.Int("v", 0, "Verbosity of logging to stderr; 1 logs added orders, 2 and 3 add debug details")
+
 	orderTypes = [...]string{
 		"market",
 		"limit",
 		"stop",
 		"cancel",
+		"stoplimit",
+		"modify",
 	}
 	orderTypesByStr = map[string]OrderType{
-		"market": Market,
-		"limit":  Limit,
-		"stop":   Stop,
-		"cancel": Cancel,
+		"market":    Market,
+		"limit":     Limit,
+		"stop":      Stop,
+		"cancel":    Cancel,
+		"stoplimit": StopLimit,
+		"modify":    Modify,
+	}
+	timeInForces = [...]string{
+		"gtc",
+		"ioc",
+		"fok",
+		"day",
+		"gtt",
+	}
+	timeInForcesByStr = map[string]TimeInForce{
+		"gtc": GoodTillCancel,
+		"ioc": ImmediateOrCancel,
+		"fok": FillOrKill,
+		"day": GoodForDay,
+		"gtt": GoodTillTime,
+	}
+	selfTradePolicies = [...]string{
+		"allow",
+		"cancel-newest",
+		"cancel-oldest",
+		"decrement",
+	}
+	selfTradePoliciesByStr = map[string]SelfTradePolicy{
+		"allow":         AllowSelfTrade,
+		"cancel-newest": CancelNewest,
+		"cancel-oldest": CancelOldest,
+		"decrement":     DecrementBoth,
 	}
 )
 
 // String returns the name of the OrderType.
 func (ot OrderType) String() string { return orderTypes[ot-1] }
 
+// String returns the name of the TimeInForce.
+func (tif TimeInForce) String() string { return timeInForces[tif] }
+
+// rests returns true if orders with the TimeInForce may rest in the book.
+func (tif TimeInForce) rests() bool {
+	return tif != ImmediateOrCancel && tif != FillOrKill
+}
+
+// String returns the name of the SelfTradePolicy.
+func (stp SelfTradePolicy) String() string { return selfTradePolicies[stp] }
+
 // String returns the name of the OrderSide.
 func (oside OrderSide) String() string {
 	if oside == BuySide {
@@ -156,11 +371,6 @@ func (oside OrderSide) String() string {
 	}
 }
 
-// String returns a readable representation of the Price.
-func (p Price) String() string {
-	return fmt.Sprintf("%.2f", p)
-}
-
 // getMatch returns Match if the two orders can match.
 func (taker *Order) getMatch(maker *Order) *Match {
 	if taker.Side == maker.Side {
@@ -171,45 +381,21 @@ func (taker *Order) getMatch(maker *Order) *Match {
 		// A Cancel order can't match anything.
 		return nil
 	}
-	//if maker.Type == Stop {
-	// A Stop order can't directly match anything as maker; it
-	// triggers when other trades execute when its threshold is
-	// reached. It can however be matched as taker.
-	//return nil
-	//}
-
-	match := false
-	price := Price(0.0)
-	// If the taker is a Stop or Market order, any value is acceptable
-	// for a match.
-	//if taker.Type == Stop {
-	// Stop orders need to be triggered first.
-	//if taker.stopTriggered {
-	//match = true
-	// TODO: Correct? What if other side is Market too, with no Limit?
-	//price = maker.Limit
-	//}
-	if taker.Type == Market {
-		match = true
-		price = maker.Limit
-	} else if taker.Side == BuySide && taker.Limit >= maker.Limit {
-		match = true
-		price = taker.Limit
-	} else if taker.Side == SellSide && taker.Limit <= maker.Limit {
-		match = true
-		price = maker.Limit
-	}
-
-	if !match {
-		log.Fatalf("No match; bug?\n")
+	if maker.level == nil || maker.cancelled || maker.executed {
+		// Only orders resting in the book can be matched as maker.
+		return nil
+	}
+	if !taker.crosses(maker.Limit) {
 		return nil
 	}
 
-	volume := taker.Volume
-	if volume > maker.Volume {
-		volume = maker.Volume
+	// Trades always happen at the price of the resting order.
+	price := maker.Limit
+	volume := taker.Remaining
+	if volume > maker.Remaining {
+		volume = maker.Remaining
 	}
-	debug("[MATCH] %q matches %q at %v, for %v units\n", taker, maker, price, volume)
+	debugv("[MATCH] %q matches %q at %v, for %v units\n", taker, maker, price, volume)
 	return &Match{
 		Taker:  taker,
 		Maker:  maker,
@@ -218,6 +404,86 @@ func (taker *Order) getMatch(maker *Order) *Match {
 	}
 }
 
+// crosses returns true if the Order is willing to trade at price.
+func (order *Order) crosses(price Price) bool {
+	if order.Type == Market || order.Type == Stop {
+		// Market orders, and triggered Stop orders which execute as
+		// Market orders, accept any price.
+		return true
+	}
+	if order.Side == BuySide {
+		return price <= order.Limit
+	}
+	return price >= order.Limit
+}
+
+// isStop returns true for Stop and StopLimit orders.
+func (order *Order) isStop() bool {
+	return order.Type == Stop || order.Type == StopLimit
+}
+
+// threshold returns the trigger price of a Stop or StopLimit Order.
+func (order *Order) threshold() Price {
+	if order.Type == StopLimit {
+		return order.StopPrice
+	}
+	return order.Limit
+}
+
+// restingPrice returns the price the Order is kept at in the book, which
+// is the threshold for untriggered stop orders and the Limit otherwise.
+func (order *Order) restingPrice() Price {
+	if order.isStop() && !order.stopTriggered {
+		return order.threshold()
+	}
+	return order.Limit
+}
+
+// execute trades the Volume of the Match between its orders.
+func (m *Match) execute() {
+	m.Maker.fill(m.Volume)
+	m.Taker.fill(m.Volume)
+}
+
+// fill records that volume units of the Order have been executed.
+func (order *Order) fill(volume Volume) {
+	order.reduce(volume)
+	order.executed = order.Remaining == 0
+}
+
+// reduce takes volume units off the Remaining units of the Order, and
+// off the displayed units of an iceberg order.
+func (order *Order) reduce(volume Volume) {
+	order.Remaining -= volume
+	if volume < order.shown {
+		order.shown -= volume
+	} else {
+		order.shown = 0
+	}
+}
+
+// Displayed returns the number of units of the Order that the book
+// displays, which is less than its Remaining units for iceberg orders.
+func (order Order) Displayed() Volume {
+	if order.Peak == 0 || order.shown > order.Remaining {
+		return order.Remaining
+	}
+	return order.shown
+}
+
+// replenish displays the next Peak units of an iceberg Order.
+func (order *Order) replenish() {
+	order.shown = order.Peak
+	if order.shown > order.Remaining {
+		order.shown = order.Remaining
+	}
+}
+
+// Filled returns the number of units of the Order that have been executed.
+func (order Order) Filled() Volume {
+	return order.Volume - order.Remaining
+}
+
 // String returns a description of the Order.
 func (order Order) String() string {
 	cancelled := ""
@@ -232,11 +498,15 @@ func (order Order) String() string {
 	if order.stopTriggered {
 		triggered = "[triggered] "
 	}
+	modified := ""
+	if order.modified {
+		modified = "[modified] "
+	}
 	idstr := ""
 	if order.id > 0 {
 		idstr = fmt.Sprintf("[id %d] ", order.id)
 	}
-	status := fmt.Sprintf("%s%s%s%s", idstr, cancelled, executed, triggered)
+	status := fmt.Sprintf("%s%s%s%s%s", idstr, cancelled, executed, triggered, modified)
 
 	cond := "?!?"
 	if order.Side == BuySide {
@@ -245,46 +515,83 @@ func (order Order) String() string {
 		cond = ">="
 	}
 
+	remaining := fmt.Sprintf("%v remaining", order.Remaining)
 	if order.Type == Market {
 		return fmt.Sprintf(
-			"%s%v order to %v %v units at market price, with %v remaining",
+			"%s%v order to %v %v units at market price, with %s",
 			status,
 			order.Type,
 			order.Side,
 			order.Volume,
-			order.Remaining,
+			remaining,
 		)
 	}
 
+	if order.Peak > 0 {
+		remaining = fmt.Sprintf("%v remaining, %v displayed", order.Remaining, order.Displayed())
+	}
+
+	opts := ""
+	if order.TimeInForce != GoodTillCancel {
+		opts += " " + order.TimeInForce.String()
+	}
+	if order.TimeInForce == GoodTillTime {
+		opts += fmt.Sprintf(" until %d", order.Expiry)
+	}
+	if order.PostOnly {
+		opts += " post-only"
+	}
+	if order.Peak > 0 {
+		opts += fmt.Sprintf(" iceberg (peak %v)", order.Peak)
+	}
+
+	stopCond := "?!?"
+	if order.Side == BuySide {
+		stopCond = ">="
+	} else if order.Side == SellSide {
+		stopCond = "<="
+	}
+
 	if order.Type == Limit {
 		return fmt.Sprintf(
-			"%s%v order to %v %v units %s $%v, with %v remaining",
+			"%s%v%s order to %v %v units %s $%v, with %s",
 			status,
 			order.Type,
+			opts,
 			order.Side,
 			order.Volume,
 			cond,
 			order.Limit,
-			order.Remaining,
+			remaining,
 		)
 	}
 
 	if order.Type == Stop {
-		cond := "?!?"
-		if order.Side == BuySide {
-			cond = ">"
-		} else if order.Side == SellSide {
-			cond = "<"
-		}
 		return fmt.Sprintf(
-			"%s%v order to %v %v units if price goes %s %v, with %v remaining",
+			"%s%v order to %v %v units if price goes %s %v, with %s",
+			status,
+			order.Type,
+			order.Side,
+			order.Volume,
+			stopCond,
+			order.Limit,
+			remaining,
+		)
+	}
+
+	if order.Type == StopLimit {
+		return fmt.Sprintf(
+			"%s%v%s order to %v %v units %s $%v if price goes %s %v, with %s",
 			status,
 			order.Type,
+			opts,
 			order.Side,
 			order.Volume,
 			cond,
 			order.Limit,
-			order.Remaining,
+			stopCond,
+			order.StopPrice,
+			remaining,
 		)
 	}
 
@@ -297,9 +604,61 @@ func (order Order) String() string {
 		)
 	}
 
+	if order.Type == Modify {
+		return fmt.Sprintf(
+			"%s%v order that changes #%v to %v units at %v",
+			status,
+			order.Type,
+			order.ToModify,
+			order.Volume,
+			order.Limit,
+		)
+	}
+
 	return "Order{???}"
 }
 
+// Line returns the Order in the format accepted by ParseOrder.
+func (order Order) Line() string {
+	side := "na"
+	if order.Side == BuySide || order.Side == SellSide {
+		side = order.Side.String()
+	}
+	var values string
+	switch order.Type {
+	case Cancel:
+		values = fmt.Sprintf("%v 0", order.ToCancel)
+	case Modify:
+		values = fmt.Sprintf("%v %v %v", order.ToModify, order.Limit, order.Volume)
+	case StopLimit:
+		values = fmt.Sprintf("%v %v %v", order.Volume, order.StopPrice, order.Limit)
+	default:
+		values = fmt.Sprintf("%v %v", order.Volume, order.Limit)
+	}
+	line := fmt.Sprintf("%v %s %s", order.Type, side, values)
+	if order.Symbol != "" {
+		line += " sym=" + order.Symbol
+	}
+	if order.Account != "" {
+		line += " acct=" + order.Account
+	}
+	if order.TimeInForce == GoodTillTime {
+		line += fmt.Sprintf(" gtt=%d", order.Expiry)
+	} else if order.TimeInForce != GoodTillCancel {
+		line += " " + order.TimeInForce.String()
+	}
+	if order.PostOnly {
+		line += " post"
+	}
+	if order.Peak > 0 {
+		line += fmt.Sprintf(" peak=%v", order.Peak)
+	}
+	if order.Time != 0 {
+		line += fmt.Sprintf(" time=%d", order.Time)
+	}
+	return line
+}
+
 // String returns a readable description of the Match.
 func (m Match) String() string {
 	return fmt.Sprintf(
@@ -311,251 +670,529 @@ func (m Match) String() string {
 	)
 }
 
-func (t orderTree) String() string {
-	if t.item == nil {
-		return ""
-	}
-	return fmt.Sprintf(" %q", t.item)
+// Error returns a description of the Reject.
+func (r *Reject) Error() string {
+	return fmt.Sprintf("order %v rejected: %s", r.Order.id, r.Reason)
 }
 
-// Output returns the output format to emit for the Match.
-func (m Match) Output() string {
-	return fmt.Sprintf("match %v %v %v %v", m.Taker.id, m.Maker.id, m.Volume, m.Price)
+// Output returns the output format to emit for the Reject.
+func (r *Reject) Output() string {
+	return fmt.Sprintf("reject %v %s", r.Order.id, r.Reason)
 }
 
-// Len, Swap and Less implements sort.Sort interface for Matches.
-func (ms Matches) Len() int      { return len(ms) }
-func (ms Matches) Swap(i, j int) { ms[i], ms[j] = ms[j], ms[i] }
-
-// Less returns whether the Matches with index i comes before index j.
-//
-// Price is checked first. Where it differs the match with best price
-// for Taker comes first.
-//
-// If first match has lower price and first match was a sell
-// order, it's better.
+// Output returns the output format to emit for the Match.
 //
-// If Price is the same, oldest Maker comes before.
-func (ms Matches) Less(i, j int) bool {
-	if ms[i].Price < ms[j].Price {
-		return ms[i].Taker.Side == SellSide
-	} else if ms[i].Price > ms[j].Price {
-		return ms[i].Taker.Side != SellSide
+// The Symbol of the orders is appended, unless they trade the default
+// instrument.
+func (m Match) Output() string {
+	out := fmt.Sprintf("match %v %v %v %v", m.Taker.id, m.Maker.id, m.Volume, m.Price)
+	if m.Taker.Symbol != "" {
+		out += " " + m.Taker.Symbol
 	}
-	return ms[i].Maker.id < ms[j].Maker.id
+	return out
 }
 
+// info logs format to stderr if -v is at least 1.
 func info(format string, a ...interface{}) {
-	if true {
-		fmt.Printf("[I] "+format, a...)
+	if *verbosity >= 1 {
+		fmt.Fprintf(os.Stderr, "[I] "+format, a...)
 	}
 }
 
+// debug logs format to stderr if -v is at least 2.
 func debug(format string, a ...interface{}) {
-	if true {
-		fmt.Printf("[D]   "+format, a...)
+	if *verbosity >= 2 {
+		fmt.Fprintf(os.Stderr, "[D]   "+format, a...)
 	}
 }
 
+// debugv logs format to stderr if -v is at least 3.
 func debugv(format string, a ...interface{}) {
-	if false {
-		fmt.Printf("[DD]     "+format, a...)
+	if *verbosity >= 3 {
+		fmt.Fprintf(os.Stderr, "[DD]     "+format, a...)
 	}
 }
 
-// newOrder returns the Order parsed from orderstr.
+// ParseError is returned by ParseOrder for an invalid order string.
+type ParseError struct {
+	// Input is the order string that could not be parsed.
+	Input string
+	// Value is the part of Input that is invalid.
+	Value string
+	// Err is the kind of problem with Value, e.g. ErrType.
+	Err error
+}
+
+var (
+	// ErrFormat is the error for order strings not of the form "[type] [side] [value1] [value2] [option]...".
+	ErrFormat = errors.New("want at least four fields")
+	// ErrType is the error for unknown order types.
+	ErrType = errors.New("invalid order type")
+	// ErrSide is the error for sides other than "buy" or "sell".
+	ErrSide = errors.New("invalid order side")
+	// ErrVolume is the error for volumes that are not positive integers.
+	ErrVolume = errors.New("invalid volume")
+	// ErrOrderNumber is the error for order numbers that are not positive integers.
+	ErrOrderNumber = errors.New("invalid order number")
+	// ErrCommand is the error for invalid commands, such as "depth x".
+	ErrCommand = errors.New("invalid command")
+	// ErrOption is the error for unknown or conflicting order options.
+	ErrOption = errors.New("invalid order option")
+	// ErrPrice is the error for prices that are not positive decimals on
+	// the tick grid.
+	ErrPrice = errors.New("invalid price")
+)
+
+// Error returns a description of the ParseError.
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%v %q in order %q", e.Err, e.Value, e.Input)
+}
+
+// Unwrap returns the kind of problem, so errors.Is can be used with e.g. ErrType.
+func (e *ParseError) Unwrap() error { return e.Err }
+
+// ParseOrder returns the Order parsed from orderstr.
 //
-// newOrder panics if orderstr is invalid.
-func newOrder(orderstr string) *Order {
-	parts := strings.Split(orderstr, " ")
-	if len(parts) != 4 {
-		log.Fatalf("Unexpected order string: %q\n", orderstr)
+// The format of orderstr is "[type] [side] [value1] [value2]", as
+// described in req.txt. For StopLimit orders, value2 is the threshold,
+// followed by an extra value with the limit, e.g.
+// "stoplimit sell 10 99.00 98.50". For Modify orders, the side is
+// ignored, value1 is the number of the order to modify, value2 is the
+// new price and an extra value holds the new volume, e.g.
+// "modify na 3 99.50 20".
+//
+// The values are optionally followed by options. For all orders:
+//
+//	sym=SYMBOL  the order trades SYMBOL, which is ignored for Cancel and
+//	            Modify orders since they find orders by number alone
+//	acct=NAME   the order belongs to the account NAME
+//	time=T      the order was submitted at T, in seconds since the Unix
+//	            epoch
+//
+// For Limit and StopLimit orders:
+//
+//	ioc     the order is ImmediateOrCancel
+//	fok     the order is FillOrKill
+//	post    the order is PostOnly
+//	peak=N  the order is an iceberg order, displaying N units at a time
+//
+// For Limit, StopLimit and Stop orders:
+//
+//	gtc     the order is GoodTillCancel, which is the default
+//	day     the order is GoodForDay
+//	gtt=T   the order is GoodTillTime, expiring at T, in seconds since
+//	        the Unix epoch
+//
+// A *ParseError is returned if orderstr is invalid.
+func ParseOrder(orderstr string) (*Order, error) {
+	parts := strings.Fields(orderstr)
+	// nvalues is the number of parts before any options.
+	nvalues := 4
+	if len(parts) < nvalues {
+		return nil, &ParseError{orderstr, orderstr, ErrFormat}
+	}
+	fail := func(value string, err error) (*Order, error) {
+		return nil, &ParseError{orderstr, value, err}
 	}
 
 	order := &Order{}
 	ot, ok := orderTypesByStr[parts[0]]
 	if !ok {
-		log.Fatalf("Unexpected order type: %q\n", parts[0])
+		return fail(parts[0], ErrType)
 	}
 	order.Type = ot
 
-	if order.Type != Cancel {
+	// The side is ignored for Cancel and Modify orders.
+	if order.Type != Cancel && order.Type != Modify {
 		if parts[1] == "buy" {
 			order.Side = BuySide
 		} else if parts[1] == "sell" {
 			order.Side = SellSide
+		} else {
+			return fail(parts[1], ErrSide)
 		}
 	}
 
 	value1, err := strconv.ParseInt(parts[2], 10, 64)
-	if err != nil {
-		log.Fatalf("Unexpected value1: %q\n", parts[2])
-	}
-	if order.Type == Cancel {
-		order.ToCancel = OrderNumber(value1)
+	if order.Type == Cancel || order.Type == Modify {
+		if err != nil || value1 <= 0 {
+			return fail(parts[2], ErrOrderNumber)
+		}
+		if order.Type == Cancel {
+			order.ToCancel = OrderNumber(value1)
+		} else {
+			order.ToModify = OrderNumber(value1)
+		}
 	} else {
+		if err != nil || value1 <= 0 {
+			return fail(parts[2], ErrVolume)
+		}
 		order.Volume = Volume(value1)
 		order.Remaining = order.Volume
 	}
 
-	value2, err := strconv.ParseFloat(parts[3], 64)
-	if err != nil {
-		log.Fatalf("Unexpected value2: %q\n", parts[3])
+	if order.Type == Limit || order.Type == Stop || order.Type == Modify {
+		price, err := ParsePrice(parts[3])
+		if err != nil || price <= 0 {
+			return fail(parts[3], ErrPrice)
+		}
+		order.Limit = price
+		if order.Type == Modify {
+			if len(parts) < 5 {
+				return fail(orderstr, ErrFormat)
+			}
+			volume, err := strconv.ParseInt(parts[4], 10, 64)
+			if err != nil || volume <= 0 {
+				return fail(parts[4], ErrVolume)
+			}
+			order.Volume = Volume(volume)
+			nvalues++
+		}
+	} else if order.Type == StopLimit {
+		if len(parts) < 5 {
+			return fail(orderstr, ErrFormat)
+		}
+		stop, err := ParsePrice(parts[3])
+		if err != nil || stop <= 0 {
+			return fail(parts[3], ErrPrice)
+		}
+		limit, err := ParsePrice(parts[4])
+		if err != nil || limit <= 0 {
+			return fail(parts[4], ErrPrice)
+		}
+		order.StopPrice = stop
+		order.Limit = limit
+		nvalues++
+	} else {
+		// The price is ignored for Market and Cancel orders, but must
+		// still be well-formed.
+		if _, err := parseDecimal(parts[3], maxDecimals); err != nil {
+			return fail(parts[3], ErrPrice)
+		}
 	}
-	if order.Type == Limit || order.Type == Stop {
-		order.Limit = Price(value2)
+
+	limitLike := order.Type == Limit || order.Type == StopLimit
+	for _, opt := range parts[nvalues:] {
+		if key, value, ok := strings.Cut(opt, "="); ok {
+			switch {
+			case key == "sym" && order.Symbol == "" && validSymbol(value):
+				order.Symbol = value
+			case key == "acct" && order.Account == "" && validSymbol(value):
+				order.Account = value
+			case key == "peak" && order.Peak == 0 && limitLike:
+				peak, err := strconv.ParseInt(value, 10, 64)
+				if err != nil || peak <= 0 {
+					return fail(opt, ErrOption)
+				}
+				order.Peak = Volume(peak)
+			case key == "gtt" && order.TimeInForce == GoodTillCancel && (limitLike || order.Type == Stop):
+				t, err := strconv.ParseInt(value, 10, 64)
+				if err != nil || t <= 0 {
+					return fail(opt, ErrOption)
+				}
+				order.TimeInForce = GoodTillTime
+				order.Expiry = t
+			case key == "time" && order.Time == 0:
+				t, err := strconv.ParseInt(value, 10, 64)
+				if err != nil || t <= 0 {
+					return fail(opt, ErrOption)
+				}
+				order.Time = t
+			default:
+				return fail(opt, ErrOption)
+			}
+			continue
+		}
+		tif, ok := timeInForcesByStr[opt]
+		switch {
+		case ok && tif != GoodTillTime && order.TimeInForce == GoodTillCancel && (limitLike || order.Type == Stop && tif.rests()):
+			order.TimeInForce = tif
+		case opt == "post" && !order.PostOnly && limitLike:
+			order.PostOnly = true
+		default:
+			return fail(opt, ErrOption)
+		}
+	}
+	if (order.PostOnly || order.Peak > 0) && !order.TimeInForce.rests() {
+		// PostOnly and iceberg orders must be able to rest in the book.
+		return fail(order.TimeInForce.String(), ErrOption)
 	}
+	if order.TimeInForce == GoodTillTime && order.Expiry <= order.Time {
+		return fail(fmt.Sprintf("gtt=%d", order.Expiry), ErrOption)
+	}
+
+	return order, nil
+}
 
+// validSymbol returns true if s can be used as a Symbol.
+func validSymbol(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// newOrder returns the Order parsed from orderstr.
+//
+// newOrder panics if orderstr is invalid.
+func newOrder(orderstr string) *Order {
+	order, err := ParseOrder(orderstr)
+	if err != nil {
+		panic(err)
+	}
 	return order
 }
 
 // newOrderBook returns a new OrderBook.
 func newOrderBook() OrderBook {
+	nextOrder := OrderNumber(1)
 	return OrderBook{
-		nextOrder: 1,
-		cancelled: map[OrderNumber]bool{},
-	}
-}
-
-// insert adds a new Order to the orders BST.
-//func (t *orderTree) insert(order *Order) {
-//	debug("insert(%q)\n", order)
-//	c := t
-//	for c != nil {
-//		if order.Limit <= c.item.Limit {
-//			debugv("inserting to left (lower)\n")
-//			c.left = &orderTree{}
-//			c = c.left
-//		} else {
-//			debugv("inserting to right (higher)\n")
-//			c.right = &orderTree{}
-//			c = c.right
-//		}
-//	}
-//	// TODO: Handle missing Limit; c.key should be nil
-//	// c.key = order.id
-//	c.item = order
-//}
-
-// insert adds a new order to the orderTree and returns the new tree.
-//
-// TODO: Change from recursion to iteration, make method on orderTree.
-func insert(node *orderTree, order *Order) *orderTree {
-	if node == nil {
-		node = &orderTree{
-			item: order,
-		}
-	} else if order.Limit <= node.item.Limit {
-		debugv("inserting %v to left (lower)\n", order.Limit)
-		node.left = insert(node.left, order)
-	} else {
-		debugv("inserting %v to right (higher)\n", order.Limit)
-		node.right = insert(node.right, order)
+		buyOrders:  newBookSide(BuySide),
+		sellOrders: newBookSide(SellSide),
+		buyStops:   newBookSide(BuySide),
+		sellStops:  newBookSide(SellSide),
+		orders:     map[OrderNumber]*Order{},
+		open:       map[openKey]Volume{},
+		nextOrder:  &nextOrder,
+		policy:     FIFO{},
 	}
-	return node
 }
 
-func traverse(t *orderTree, desc string) {
-	if t == nil {
-		return
+// side returns the bookSide holding resting orders for side.
+func (book *OrderBook) side(side OrderSide) *bookSide {
+	if side == BuySide {
+		return book.buyOrders
 	}
-	traverse(t.left, desc+"L")
-	debug("traversing [%v] %v: %+v\n", desc, t.item.id, t.item)
-	traverse(t.right, desc+"R")
+	return book.sellOrders
 }
 
-// exec traverses the BST and returns the Match, if any.
-//
-// If max is true, orders with limit values >= specified value are returned.
-// If max is false, orders with limit values <= specified value are returned.
-func (node *orderTree) exec(taker *Order, wantHighest bool) *Match {
-	c := node
-	makers := []*Order{}
-	debug("exec(%q)\n", taker)
-	// TODO: Handle missing Limit for Market
-	for c != nil {
-		if wantHighest {
-			if c.item.Limit >= taker.Limit {
-				makers = append(makers, c.item)
-				debugv("fetched order: %v\n", makers)
-			}
-			debugv("fetching right (higher)\n")
-			c = c.right
-		} else {
-			if c.item.Limit <= taker.Limit {
-				makers = append(makers, c.item)
-				debugv("fetched order: %v\n", makers)
-			}
-			debugv("fetching left (lower)\n")
-			c = c.left
-		}
-		time.Sleep(time.Millisecond * 200) // TODO: Remove
+// stops returns the bookSide holding untriggered stop orders for side.
+func (book *OrderBook) stops(side OrderSide) *bookSide {
+	if side == BuySide {
+		return book.buyStops
 	}
+	return book.sellStops
+}
 
-	matches := Matches{}
-	for _, maker := range makers {
-		matches = append(matches, taker.getMatch(maker))
+// opposite returns the bookSide holding resting orders that can match
+// orders on side.
+func (book *OrderBook) opposite(side OrderSide) *bookSide {
+	if side == BuySide {
+		return book.sellOrders
+	}
+	return book.buyOrders
+}
+
+// holder returns the bookSide that order rests in.
+func (book *OrderBook) holder(order *Order) *bookSide {
+	if order.isStop() && !order.stopTriggered {
+		return book.stops(order.Side)
 	}
-	sort.Sort(sort.Reverse(matches))
+	return book.side(order.Side)
+}
 
-	if len(matches) == 0 {
-		debug("exec() found no matches\n")
-		return nil
+// emit reports event to the events func of the book, if any.
+func (book *OrderBook) emit(format string, a ...interface{}) {
+	if book.events != nil {
+		book.events(fmt.Sprintf(format, a...))
 	}
-	debugv("exec() got matches: %v\n", matches)
+}
 
-	// Execute the order.
-	match := matches[0]
-	match.Maker.Volume -= match.Volume
-	if match.Maker.Volume <= 0.0 {
-		match.Maker.executed = true
+// rest adds order to s, making it available for later matching.
+//
+// An iceberg order displays its first Peak units. Orders with an Expiry
+// are queued to expire.
+func (book *OrderBook) rest(s *bookSide, order *Order) {
+	order.replenish()
+	s.add(order)
+	book.orders[order.id] = order
+	book.opened(order, order.Remaining)
+	if book.resting != nil {
+		book.resting[order.id] = book
 	}
-	match.Taker.Volume -= match.Volume
-	if match.Taker.Volume <= 0.0 {
-		match.Taker.executed = true
+	if order.Expiry > 0 && !order.queued {
+		order.queued = true
+		heap.Push(&book.expiries, order)
 	}
-	debug("exec() excuted %q\n", match)
-	return match
 }
 
-// delete removes an Order from the BST.
-func (t *orderTree) delete(order *Order) {
-	// TODO: Need a reference to the tree here.. even if we store a pointer
-	// back to the *orderTree, we'd still need a reference to its parent to
-	// be able to drop that parent's reference when we delete
-	// though. Looking up node by order.id is O(n).
-	debug("delete(%v)\n", order)
+// remove takes order out of s.
+func (book *OrderBook) remove(s *bookSide, order *Order) {
+	s.remove(order)
+	delete(book.orders, order.id)
+	delete(book.resting, order.id)
+	book.closed(order, order.Remaining)
 }
 
-// findStops returns all Stop orders triggered by specified price.
-func (book *OrderBook) findStops(order *Order) []*Order {
-	// TODO: Traverse stopOrders to find if order triggers any stop
-	// order. If it did, we should add that stop order to buyOrders or
-	// sellOrders, and execute that order if so.
+// opened adds volume units of the resting order to the open units of
+// its Account.
+func (book *OrderBook) opened(order *Order, volume Volume) {
+	if order.Account != "" {
+		book.open[openKey{order.Account, order.Side}] += volume
+	}
+}
 
-	c := book.stopOrders
-	wantHighest := order.Side == BuySide
-	triggered := []*Order{}
-	debug("findStops(%v)\n", order)
-	for c != nil {
-		if wantHighest {
-			if c.item.Limit >= order.Limit {
-				triggered = append(triggered, c.item)
-				debugv("fetched order: %v\n", triggered)
-			}
-			debugv("fetching right (higher)\n")
-			c = c.right
+// closed takes volume units of the resting order off the open units of
+// its Account, once they have been executed or cancelled.
+func (book *OrderBook) closed(order *Order, volume Volume) {
+	if order.Account == "" {
+		return
+	}
+	key := openKey{order.Account, order.Side}
+	if book.open[key] -= volume; book.open[key] == 0 {
+		delete(book.open, key)
+	}
+}
+
+// match executes taker against the resting orders on the opposite side
+// of the book, best price first, until taker is executed or no further
+// orders match. Within each price, taker is shared among the orders as
+// given by the MatchingPolicy of the book.
+func (book *OrderBook) match(taker *Order) Matches {
+	makers := book.opposite(taker.Side)
+	matches := Matches{}
+	for !taker.executed && !taker.cancelled {
+		level := makers.best()
+		if level == nil || !taker.crosses(level.price) {
+			break
+		}
+		levelMatches, ok := book.matchLevel(taker, level)
+		matches = append(matches, levelMatches...)
+		if !ok {
+			break
+		}
+	}
+	debugv("No new matches, returning the ones we have: %v\n", matches)
+	return matches
+}
+
+// matchLevel executes taker against the orders at level, as allocated by
+// the MatchingPolicy of the book.
+//
+// If an order at the level can't trade with taker, the matches so far
+// are returned, and the level must be tried again. false is returned if
+// nothing could be allocated.
+func (book *OrderBook) matchLevel(taker *Order, level *priceLevel) (Matches, bool) {
+	makers := []*Order{}
+	sizes := []Volume{}
+	volume := Volume(0)
+	_, fifo := book.policy.(FIFO)
+	level.each(func(maker *Order) bool {
+		makers = append(makers, maker)
+		sizes = append(sizes, maker.Displayed())
+		volume += maker.Displayed()
+		// FIFO gives nothing to the orders behind those that cover
+		// taker, so they needn't be looked at.
+		return !fifo || volume < taker.Remaining
+	})
+	if volume > taker.Remaining {
+		volume = taker.Remaining
+	}
+	alloc := book.policy.Allocate(sizes, volume)
+	matches := Matches{}
+	for i, maker := range makers {
+		if alloc[i] == 0 {
+			continue
+		}
+		match := taker.getMatch(maker)
+		if match == nil {
+			return matches, false
+		}
+		match.Volume = alloc[i]
+		if book.selfTrade(match) {
+			// The level has changed, so it must be allocated again.
+			return matches, true
+		}
+		match.execute()
+		book.closed(maker, match.Volume)
+		book.last = match.Price
+		debug("Executed %q\n", match)
+		if book.events != nil {
+			book.events(match.Output())
+		}
+		matches = append(matches, match)
+		if maker.executed {
+			book.remove(book.side(maker.Side), maker)
 		} else {
-			if c.item.Limit <= order.Limit {
-				triggered = append(triggered, c.item)
-				debugv("fetched order: %v\n", triggered)
+			book.requeue(maker)
+		}
+	}
+	return matches, len(matches) > 0
+}
+
+// requeue replenishes the resting iceberg order once its displayed part
+// has been executed, and moves it to the back of the queue at its level.
+func (book *OrderBook) requeue(order *Order) {
+	if order.Peak == 0 || order.shown > 0 {
+		return
+	}
+	order.replenish()
+	order.level.orders.MoveToBack(order.elem)
+	book.emit("replenished %v", order.id)
+}
+
+// selfTrade applies the self-trade policy of the book if the orders of
+// match belong to the same Account. It returns true if the orders must
+// not trade.
+func (book *OrderBook) selfTrade(match *Match) bool {
+	taker, maker := match.Taker, match.Maker
+	if book.stp == AllowSelfTrade || taker.Account == "" || taker.Account != maker.Account {
+		return false
+	}
+	info("Preventing self-trade of %v with %v in account %v\n", taker.id, maker.id, taker.Account)
+	switch book.stp {
+	case CancelNewest:
+		taker.cancelled = true
+		book.emit("cancelled %v", taker.id)
+	case CancelOldest:
+		book.cancel(maker.id)
+	case DecrementBoth:
+		for _, order := range []*Order{maker, taker} {
+			order.Volume -= match.Volume
+			order.reduce(match.Volume)
+			if order == maker {
+				book.closed(maker, match.Volume)
 			}
-			debugv("fetching left (lower)\n")
-			c = c.left
+			book.emit("decremented %v %v", order.id, match.Volume)
+		}
+		if maker.Remaining == 0 {
+			book.cancel(maker.id)
+		} else if maker.shown == 0 {
+			maker.replenish()
+		}
+		if taker.Remaining == 0 {
+			taker.cancelled = true
+			book.emit("cancelled %v", taker.id)
 		}
-		time.Sleep(time.Millisecond * 200) // TODO: Remove
 	}
+	return true
+}
 
+// findStops returns all Stop orders triggered by a trade at price,
+// oldest first.
+func (book *OrderBook) findStops(price Price) []*Order {
+	triggered := []*Order{}
+	collect := func(level *priceLevel) bool {
+		return level.each(func(stop *Order) bool {
+			triggered = append(triggered, stop)
+			return true
+		})
+	}
+	book.buyStops.levels.ascend(func(level *priceLevel) bool {
+		return level.price <= price && collect(level)
+	})
+	book.sellStops.levels.descend(func(level *priceLevel) bool {
+		return level.price >= price && collect(level)
+	})
+	sort.Slice(triggered, func(i, j int) bool {
+		return triggered[i].id < triggered[j].id
+	})
+	debugv("findStops(%v) found %v\n", price, triggered)
 	return triggered
 }
 
@@ -565,130 +1202,426 @@ func (book *OrderBook) findStops(order *Order) []*Order {
 // matching depends on the type.
 //
 // If there's matching orders, they are executed, and the resulting
-// matches are returned.
-func (book *OrderBook) Add(taker *Order) Matches {
-	taker.id = book.nextOrder
-	book.nextOrder++
+// matches are returned. Any unexecuted part of a Limit order is left
+// resting in the book.
+//
+// During an auction, orders rest in the book without matching, and
+// orders that must execute right away are rejected.
+//
+// A *Reject error is returned if the Order is refused by the book.
+func (book *OrderBook) Add(taker *Order) (Matches, error) {
+	taker.id = *book.nextOrder
+	*book.nextOrder++
+	taker.Symbol = book.symbol
 	if taker.Type == Cancel {
-		book.cancelled[taker.ToCancel] = true
-		// TODO: Delete taker.ToCancel from appropriate tree here by
-		// traversing them and then deleting the order.
-		debug("Cancelled %v\n", taker.ToCancel)
-		return nil
+		book.cancel(taker.ToCancel)
+		return nil, nil
+	}
+	if taker.Type == Modify {
+		return book.modify(taker)
 	}
-	if taker.Type == Stop {
+	if book.auction && (taker.Type == Market || !taker.TimeInForce.rests()) {
+		kind := taker.Type.String()
+		if taker.Type != Market {
+			kind = taker.TimeInForce.String()
+		}
+		return nil, &Reject{taker, fmt.Sprintf("%s order can't execute during auction", kind)}
+	}
+	if taker.isStop() {
 		debug("Added stop order %v\n", taker)
-		book.stopOrders = insert(book.stopOrders, taker)
-		return nil
+		book.rest(book.stops(taker.Side), taker)
+		return nil, nil
 	}
-
-	if taker.Side == BuySide {
-		book.buyOrders = insert(book.buyOrders, taker)
-	} else {
-		book.sellOrders = insert(book.sellOrders, taker)
+	if reason := book.refusal(taker); reason != "" {
+		taker.cancelled = true
+		return nil, &Reject{taker, reason}
 	}
 	info("Added order %q\n", taker)
+	return book.place(taker), nil
+}
 
-	// TODO: Need to pass on a reference to the book.buyOrders *orderTree here to exec, so it can
+// refusal returns why taker can't be placed in the book right now, or ""
+// if it can: PostOnly orders must not match, and FillOrKill orders must
+// be filled in full.
+func (book *OrderBook) refusal(taker *Order) string {
+	if book.auction {
+		return ""
+	}
+	if taker.PostOnly && book.opposite(taker.Side).crossedBy(taker) {
+		return "post-only order would match"
+	}
+	if taker.TimeInForce == FillOrKill && book.available(taker) < taker.Remaining {
+		return "fill-or-kill order can't be filled"
+	}
+	return ""
+}
+
+// place executes taker against the book, and rests any unexecuted part
+// of Limit and triggered StopLimit orders in the book.
+//
+// Modified and triggered orders that the book refuses are cancelled.
+func (book *OrderBook) place(taker *Order) Matches {
+	if book.auction {
+		book.rest(book.side(taker.Side), taker)
+		return nil
+	}
+	if reason := book.refusal(taker); reason != "" {
+		taker.cancelled = true
+		info("Cancelled order %v: %s\n", taker.id, reason)
+		book.emit("cancelled %v", taker.id)
+		return nil
+	}
 
 	// Look for matches for the recently added order.
-	matches := Matches{}
-	for !taker.executed {
-		var match *Match
-		if taker.Side == BuySide {
-			match = book.sellOrders.exec(taker, false)
+	matches := book.match(taker)
+	if !taker.executed && !taker.cancelled && (taker.Type == Limit || taker.Type == StopLimit) {
+		if taker.TimeInForce.rests() {
+			book.rest(book.side(taker.Side), taker)
 		} else {
-			match = book.buyOrders.exec(taker, true)
+			taker.cancelled = true
 		}
-		if match == nil {
-			debug("No new matches, returning the ones we have: %v\n", matches)
-			return matches
+	}
+	// Market orders never rest in the book; whatever could not be
+	// executed right away is dropped.
+	return matches
+}
+
+// available returns the number of units that taker could execute right
+// away against the resting orders in the book, up to its Remaining units.
+//
+// Orders of the same Account as taker don't count unless the book
+// allows self-trades, since they would never trade with it.
+func (book *OrderBook) available(taker *Order) Volume {
+	volume := Volume(0)
+	book.opposite(taker.Side).each(func(level *priceLevel) bool {
+		if !taker.crosses(level.price) {
+			return false
 		}
-		debug("Adding best new match found: %v\n", match)
-		matches = append(matches, match)
-		// TODO: Both taker and maker are executed if we made it here, need
-		// to be deleted from BST.
-		if taker.Side == BuySide {
-			if match.Taker.executed {
-				book.buyOrders.delete(match.Taker)
+		return level.each(func(maker *Order) bool {
+			if book.stp != AllowSelfTrade && taker.Account != "" && taker.Account == maker.Account {
+				return true
 			}
-			if match.Maker.executed {
-				book.sellOrders.delete(match.Maker)
-			}
-		} else {
-			if match.Taker.executed {
-				book.sellOrders.delete(match.Taker)
-			}
-			if match.Maker.executed {
-				book.buyOrders.delete(match.Maker)
-			}
-		}
+			volume += maker.Remaining
+			return volume < taker.Remaining
+		})
+	})
+	if volume > taker.Remaining {
+		volume = taker.Remaining
 	}
-	return matches
+	return volume
+}
+
+// cancel removes the resting order with number id from the book, and
+// marks it as cancelled.
+//
+// Any unexecuted part of a partially executed order is cancelled.
+// Cancelling an unknown, fully executed or previously cancelled order is
+// a no-op.
+func (book *OrderBook) cancel(id OrderNumber) {
+	order, ok := book.orders[id]
+	if !ok {
+		debug("No resting order %v to cancel\n", id)
+		return
+	}
+	book.remove(book.holder(order), order)
+	order.cancelled = true
+	debug("Cancelled %v\n", order)
+	book.emit("cancelled %v", order.id)
+}
+
+// modify changes the price and size of the resting order given by
+// mod.ToModify, as described for Modify.
+//
+// If the price is changed, the order is executed again at the new price
+// and any resulting matches are returned.
+func (book *OrderBook) modify(mod *Order) (Matches, error) {
+	order, ok := book.orders[mod.ToModify]
+	if !ok {
+		return nil, &Reject{mod, fmt.Sprintf("no open order %v to modify", mod.ToModify)}
+	}
+	if mod.Volume <= order.Filled() {
+		return nil, &Reject{mod, fmt.Sprintf("order %v already has %v units executed", order.id, order.Filled())}
+	}
+	order.modified = true
+	filled := order.Filled()
+	if mod.Limit == order.Limit && mod.Volume <= order.Volume {
+		book.closed(order, order.Volume-mod.Volume)
+		order.Volume = mod.Volume
+		order.Remaining = mod.Volume - filled
+		debug("Reduced %v\n", order)
+		return nil, nil
+	}
+
+	s := book.holder(order)
+	book.remove(s, order)
+	order.Volume = mod.Volume
+	order.Remaining = mod.Volume - filled
+	order.Limit = mod.Limit
+	debug("Modified %v\n", order)
+	if order.isStop() && !order.stopTriggered {
+		book.rest(s, order)
+		return nil, nil
+	}
+	return book.place(order), nil
 }
 
-// getStopMatches returns any matches for stop orders triggered by the matches.
+// getTriggeredStops returns any matches for stop orders triggered by the matches.
+//
+// Triggered stop orders are removed from the book and executed, oldest
+// first. Stop orders execute as Market orders, and StopLimit orders as
+// Limit orders. Matches for triggered stop orders may in turn
+// trigger further stop orders, which are executed after them.
 func (book *OrderBook) getTriggeredStops(oldMatches Matches) Matches {
 	matches := Matches{}
-	for _, oldMatch := range oldMatches {
-		// TODO: Each oldMatch.Taker here is an executed order. We know
-		// the oldMatch.Price, and now need to traverse the BST to find if
-		// this price is below any SellSide Stop order's Limit, or above
-		// any BuySide Stop order's Limit. If so, they trigger and we want
-		// to match + execute them, and return the matches.
-
-		for _, taker := range book.findStops(oldMatch.Taker) {
-			// Any Order in triggered is a Stop order which was triggered by
-			// recent executions. They should be removed from stopOrders, and
-			// added to buyOrders / sellOrders.
-			debug("Should delete stopOrder %v\n", taker)
-			book.stopOrders.delete(taker)
-			if taker.Side == BuySide {
-				debug("Adding triggered stoporder to buyOrders: %q\n", taker)
-				book.buyOrders = insert(book.buyOrders, taker)
-			} else {
-				debug("Adding triggered stoporder to sellOrders: %q\n", taker)
-				book.sellOrders = insert(book.sellOrders, taker)
-			}
-
-			// Look for matches for the recently triggered stop order.
-			for !taker.executed {
-				var match *Match
-				if taker.Side == BuySide {
-					match = book.sellOrders.exec(taker, false)
-				} else {
-					match = book.buyOrders.exec(taker, true)
-				}
-				if match == nil {
-					debug("No new matches, returning the ones we have: %v\n", matches)
-					return matches
-				}
-				debug("Adding best new match found: %v\n", match)
-				matches = append(matches, match)
+	triggered := []*Order{}
+	trigger := func(ms Matches) {
+		for _, m := range ms {
+			for _, stop := range book.findStops(m.Price) {
+				book.remove(book.holder(stop), stop)
+				stop.stopTriggered = true
+				book.emit("triggered %v", stop.id)
+				triggered = append(triggered, stop)
 			}
 		}
 	}
+	trigger(oldMatches)
+	for len(triggered) > 0 {
+		taker := triggered[0]
+		triggered = triggered[1:]
+		debug("Executing triggered stop order %q\n", taker)
+		stopMatches := book.place(taker)
+		matches = append(matches, stopMatches...)
+		trigger(stopMatches)
+	}
 	return matches
 }
 
-func main() {
-	book := newOrderBook()
-	scanner := bufio.NewScanner(os.Stdin)
-	for scanner.Scan() {
+// output writes the result of adding an Order to w.
+//
+// Any error other than a *Reject is returned.
+func output(w io.Writer, matches Matches, err error) error {
+	if r, ok := err.(*Reject); ok {
+		fmt.Fprintln(w, r.Output())
+	} else if err != nil {
+		return err
+	}
+	for _, match := range matches {
+		fmt.Fprintln(w, match.Output())
+	}
+	return nil
+}
+
+// commandArgs holds the number of arguments of each command accepted by
+// runCommand, besides the optional sym=SYMBOL.
+var commandArgs = map[string]int{
+	"depth":      1,
+	"auction":    0,
+	"uncross":    0,
+	"indicative": 0,
+}
+
+// runCommand runs the command in line, if it is one, and writes its
+// output to w. It returns false if line is not a command.
+//
+// The commands act on the book for SYMBOL, or for the default instrument
+// without sym=SYMBOL:
+//
+//	depth N [sym=SYMBOL]     write the best N levels on each side
+//	auction [sym=SYMBOL]     start an auction, where orders don't match
+//	uncross [sym=SYMBOL]     end the auction, executing the crossing
+//	                         orders at a single price
+//	indicative [sym=SYMBOL]  write the price, volume and imbalance that
+//	                         uncross would give now
+func runCommand(ex *Exchange, line string, w io.Writer) (bool, error) {
+	parts := strings.Fields(line)
+	if len(parts) == 0 {
+		return false, nil
+	}
+	nargs, ok := commandArgs[parts[0]]
+	if !ok {
+		return false, nil
+	}
+	fail := func(value string) (bool, error) {
+		return true, &ParseError{line, value, ErrCommand}
+	}
+	symbol := ""
+	if last := parts[len(parts)-1]; len(parts) > 1 && strings.HasPrefix(last, "sym=") {
+		symbol = strings.TrimPrefix(last, "sym=")
+		if !validSymbol(symbol) {
+			return fail(last)
+		}
+		parts = parts[:len(parts)-1]
+	}
+	if len(parts) != nargs+1 {
+		return fail(line)
+	}
+	book, ok := ex.books[symbol]
+	switch parts[0] {
+	case "depth":
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n <= 0 {
+			return fail(parts[1])
+		}
+		if ok {
+			book.writeDepth(w, n)
+		}
+	case "auction":
+		ex.StartAuction(symbol)
+	case "uncross":
+		return true, output(w, ex.Uncross(symbol), nil)
+	case "indicative":
+		if ok {
+			book.writeIndicative(w)
+		}
+	}
+	return true, nil
+}
+
+// run reads orders and commands from r, one per line, adds the orders to
+// ex and writes the resulting matches to w.
+//
+// Invalid lines are reported to errw along with their line number and
+// skipped, unless strict is set, in which case an error is returned for
+// the first invalid line.
+func run(ex *Exchange, r io.Reader, w, errw io.Writer, strict bool) error {
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
 		orderstr := scanner.Text()
-		if err := scanner.Err(); err != nil {
-			log.Fatalf("Failed to read standard input: %v\n", err)
+		if strings.TrimSpace(orderstr) == "" {
+			continue
 		}
-		order := newOrder(orderstr)
+		isCommand, err := runCommand(ex, orderstr, w)
+		if isCommand && err == nil {
+			continue
+		}
+		var order *Order
+		if !isCommand {
+			order, err = ParseOrder(orderstr)
+		}
+		if err != nil {
+			if strict {
+				return fmt.Errorf("line %d: %w", lineno, err)
+			}
+			fmt.Fprintf(errw, "line %d: rejected: %v\n", lineno, err)
+			continue
+		}
+		// Orders that expire by the time of this one are gone before it
+		// can match them.
+		writeExpired(w, ex.Expire(order.Time))
 		// TODO: Maybe type returned here should be Executions or
 		// something; "matches" is misleading since we already executed them.
-		matches := book.Add(order)
-		for _, match := range matches {
-			fmt.Println(match.Output())
+		matches, err := ex.Add(order)
+		if err := output(w, matches, err); err != nil {
+			return fmt.Errorf("line %d: %w", lineno, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read input: %v", err)
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	// exitCode is set by failures after which the deferred calls must
+	// still run, such as flushing the market data.
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+	if err := SetTickSize(*tickSizeFlag); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	ex := newExchange()
+	stp, ok := selfTradePoliciesByStr[*stpFlag]
+	if !ok {
+		log.Fatalf("Invalid -stp %q\n", *stpFlag)
+	}
+	ex.stp = stp
+	risk, err := riskChecks()
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	ex.risk = risk
+	symbols, err := parseSymbols(*proRata)
+	if err != nil {
+		log.Fatalf("Invalid -pro_rata: %v\n", err)
+	}
+	for _, symbol := range symbols {
+		ex.policies[symbol] = ProRata{Volume(*minAllocation)}
+	}
+	if *backtestPath != "" {
+		if err := backtest(ex, *backtestPath); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		return
+	}
+	if *journalPath != "" && *replay {
+		f, err := os.Open(*journalPath)
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		defer f.Close()
+		if _, _, err := replayJournal(f, ex, os.Stdout); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		return
+	}
+	if *journalPath != "" {
+		j, err := openJournal(*journalPath, ex)
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		defer j.Close()
+	}
+	if *marketDataPath != "" {
+		md, closeMarketData, err := openMarketData(*marketDataPath, *marketDataFormat, *barInterval)
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		defer func() {
+			if err := closeMarketData(); err != nil {
+				log.Fatalf("%v\n", err)
+			}
+		}()
+		ex.marketData = md
+	}
+	if *listen != "" {
+		l, err := net.Listen("tcp", *listen)
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		info("Accepting orders on %v\n", l.Addr())
+		// Stop accepting orders on SIGINT or SIGTERM, and return so that
+		// the journal and market data are closed.
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			info("Stopping on %v\n", <-sigs)
+			l.Close()
+		}()
+		if err := serveOrders(ex, l, *fixFlag); err != nil {
+			log.Printf("%v\n", err)
+			exitCode = 1
+		}
+		return
+	}
+	if err := run(ex, os.Stdin, os.Stdout, os.Stderr, *strict); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	ex.writePositions(os.Stdout)
+	if *snapshotPath != "" {
+		f, err := os.Create(*snapshotPath)
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		if err := ex.WriteLevel3(f); err != nil {
+			log.Fatalf("Failed to write snapshot: %v\n", err)
 		}
-		// The matches for order might have triggered some stop orders.
-		for _, match := range book.getTriggeredStops(matches) {
-			fmt.Println(match.Output())
+		if err := f.Close(); err != nil {
+			log.Fatalf("Failed to write snapshot: %v\n", err)
 		}
 	}
 }
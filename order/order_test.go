@@ -1,7 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"math/rand"
+	"strings"
 	"testing"
 )
 
@@ -37,7 +41,7 @@ func TestOrder_String(t *testing.T) {
 				Side:      SellSide,
 				Volume:    3,
 				Remaining: 2,
-				Limit:     3.4,
+				Limit:     340,
 			},
 			want: "[id 3] [cancelled] limit order to sell 3 units >= $3.40, with 2 remaining",
 		},
@@ -50,9 +54,90 @@ func TestOrder_String(t *testing.T) {
 				Side:          BuySide,
 				Volume:        3,
 				Remaining:     0,
-				Limit:         3.4,
+				Limit:         340,
 			},
-			want: "[id 4] [executed] [triggered] stop order to buy 3 units if price goes > 3.40, with 0 remaining",
+			want: "[id 4] [executed] [triggered] stop order to buy 3 units if price goes >= 3.40, with 0 remaining",
+		},
+		{
+			in: Order{
+				id:        5,
+				Type:      Limit,
+				Side:      BuySide,
+				Volume:    10,
+				Remaining: 4,
+				Limit:     9950,
+			},
+			want: "[id 5] limit order to buy 10 units <= $99.50, with 4 remaining",
+		},
+		{
+			in: Order{
+				id:          7,
+				Type:        Limit,
+				Side:        SellSide,
+				Volume:      10,
+				Remaining:   10,
+				Limit:       9950,
+				TimeInForce: FillOrKill,
+			},
+			want: "[id 7] limit fok order to sell 10 units >= $99.50, with 10 remaining",
+		},
+		{
+			in: Order{
+				id:        8,
+				Type:      Limit,
+				Side:      BuySide,
+				Volume:    10,
+				Remaining: 10,
+				Limit:     9950,
+				PostOnly:  true,
+			},
+			want: "[id 8] limit post-only order to buy 10 units <= $99.50, with 10 remaining",
+		},
+		{
+			in: Order{
+				id:            6,
+				stopTriggered: true,
+				Type:          Stop,
+				Side:          SellSide,
+				Volume:        7,
+				Remaining:     2,
+				Limit:         9949,
+			},
+			want: "[id 6] [triggered] stop order to sell 7 units if price goes <= 99.49, with 2 remaining",
+		},
+		{
+			in: Order{
+				id:        9,
+				Type:      StopLimit,
+				Side:      SellSide,
+				Volume:    10,
+				Remaining: 10,
+				StopPrice: 9900,
+				Limit:     9850,
+			},
+			want: "[id 9] stoplimit order to sell 10 units >= $98.50 if price goes <= 99.00, with 10 remaining",
+		},
+		{
+			in: Order{
+				id:        10,
+				modified:  true,
+				Type:      Limit,
+				Side:      BuySide,
+				Volume:    6,
+				Remaining: 2,
+				Limit:     9900,
+			},
+			want: "[id 10] [modified] limit order to buy 6 units <= $99.00, with 2 remaining",
+		},
+		{
+			in: Order{
+				id:       11,
+				Type:     Modify,
+				ToModify: 10,
+				Volume:   6,
+				Limit:    9900,
+			},
+			want: "[id 11] modify order that changes #10 to 6 units at 99.00",
 		},
 		{
 			in: Order{
@@ -74,23 +159,504 @@ func TestOrder_String(t *testing.T) {
 	}
 }
 
+// addAll feeds the orders in lines through book, returning the output
+// lines for the resulting matches.
+func addAll(book *OrderBook, lines ...string) []string {
+	out := []string{}
+	for _, line := range lines {
+		matches, err := book.Add(newOrder(line))
+		if r, ok := err.(*Reject); ok {
+			out = append(out, r.Output())
+		}
+		matches = append(matches, book.getTriggeredStops(matches)...)
+		for _, m := range matches {
+			out = append(out, m.Output())
+		}
+	}
+	return out
+}
+
+func TestParseOrder(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    Order
+		wantErr error
+	}{
+		{
+			in:   "market buy 1000 0.0",
+			want: Order{Type: Market, Side: BuySide, Volume: 1000, Remaining: 1000},
+		},
+		{
+			in:   "limit sell 10 55.0",
+			want: Order{Type: Limit, Side: SellSide, Volume: 10, Remaining: 10, Limit: 5500},
+		},
+		{
+			in:   "stop buy 20 99.49",
+			want: Order{Type: Stop, Side: BuySide, Volume: 20, Remaining: 20, Limit: 9949},
+		},
+		{
+			in:   "cancel na 2 0.00",
+			want: Order{Type: Cancel, ToCancel: 2},
+		},
+		{in: "limit buy 10", wantErr: ErrFormat},
+		{
+			in:   "limit buy 10 99.00 ioc",
+			want: Order{Type: Limit, Side: BuySide, Volume: 10, Remaining: 10, Limit: 9900, TimeInForce: ImmediateOrCancel},
+		},
+		{
+			in:   "limit sell 10 99.00 fok",
+			want: Order{Type: Limit, Side: SellSide, Volume: 10, Remaining: 10, Limit: 9900, TimeInForce: FillOrKill},
+		},
+		{
+			in:   "limit sell 10 99.00 post",
+			want: Order{Type: Limit, Side: SellSide, Volume: 10, Remaining: 10, Limit: 9900, PostOnly: true},
+		},
+		{
+			in:   "stoplimit sell 10 99.00 98.50",
+			want: Order{Type: StopLimit, Side: SellSide, Volume: 10, Remaining: 10, StopPrice: 9900, Limit: 9850},
+		},
+		{
+			in:   "stoplimit buy 10 101.00 101.50 ioc",
+			want: Order{Type: StopLimit, Side: BuySide, Volume: 10, Remaining: 10, StopPrice: 10100, Limit: 10150, TimeInForce: ImmediateOrCancel},
+		},
+		{in: "stoplimit sell 10 99.00", wantErr: ErrFormat},
+		{in: "stoplimit sell 10 99.00 0.00", wantErr: ErrPrice},
+		{in: "stop sell 10 99.00 98.50", wantErr: ErrOption},
+		{
+			in:   "modify na 3 99.50 20",
+			want: Order{Type: Modify, ToModify: 3, Limit: 9950, Volume: 20},
+		},
+		{in: "modify na 3 99.50", wantErr: ErrFormat},
+		{in: "modify na 0 99.50 20", wantErr: ErrOrderNumber},
+		{in: "modify na 3 0.00 20", wantErr: ErrPrice},
+		{in: "modify na 3 99.50 0", wantErr: ErrVolume},
+		{in: "modify na 3 99.50 20 ioc", wantErr: ErrOption},
+		{
+			in:   "limit buy 10 99.00 sym=AAPL ioc",
+			want: Order{Type: Limit, Side: BuySide, Volume: 10, Remaining: 10, Limit: 9900, TimeInForce: ImmediateOrCancel, Symbol: "AAPL"},
+		},
+		{
+			in:   "cancel na 2 0.00 sym=AAPL",
+			want: Order{Type: Cancel, ToCancel: 2, Symbol: "AAPL"},
+		},
+		{in: "limit buy 10 99.00 sym=", wantErr: ErrOption},
+		{in: "limit buy 10 99.00 sym=A/B", wantErr: ErrOption},
+		{in: "limit buy 10 99.00 sym=A sym=B", wantErr: ErrOption},
+		{
+			in:   "market sell 5 0.00 time=1700000000",
+			want: Order{Type: Market, Side: SellSide, Volume: 5, Remaining: 5, Time: 1700000000},
+		},
+		{in: "limit buy 10 99.00 time=0", wantErr: ErrOption},
+		{in: "limit buy 10 99.00 time=1.5", wantErr: ErrOption},
+		{in: "limit buy 10 99.00 acct=A/B", wantErr: ErrOption},
+		{in: "limit buy 10 99.00 owner=A", wantErr: ErrOption},
+		{in: "limit buy 10 99.00 extra", wantErr: ErrOption},
+		{in: "limit buy 10 99.00 ioc fok", wantErr: ErrOption},
+		{in: "limit buy 10 99.00 post post", wantErr: ErrOption},
+		{in: "limit buy 10 99.00 post ioc", wantErr: ErrOption},
+		{in: "market buy 10 0.00 ioc", wantErr: ErrOption},
+		{in: "limit buy 10 99.00 peak=0", wantErr: ErrOption},
+		{in: "limit buy 10 99.00 peak=2 ioc", wantErr: ErrOption},
+		{in: "stop buy 10 99.00 peak=2", wantErr: ErrOption},
+		{
+			in:   "stop sell 10 99.00 day",
+			want: Order{Type: Stop, Side: SellSide, Volume: 10, Remaining: 10, Limit: 9900, TimeInForce: GoodForDay},
+		},
+		{
+			in:   "limit buy 10 99.00 gtt=1700000060 time=1700000000",
+			want: Order{Type: Limit, Side: BuySide, Volume: 10, Remaining: 10, Limit: 9900, TimeInForce: GoodTillTime, Expiry: 1700000060, Time: 1700000000},
+		},
+		{in: "limit buy 10 99.00 gtt", wantErr: ErrOption},
+		{in: "limit buy 10 99.00 gtt=0", wantErr: ErrOption},
+		{in: "limit buy 10 99.00 gtt=60 day", wantErr: ErrOption},
+		{in: "limit buy 10 99.00 gtt=60 time=60", wantErr: ErrOption},
+		{in: "stop buy 10 99.00 ioc", wantErr: ErrOption},
+		{in: "market buy 10 0.00 day", wantErr: ErrOption},
+		{in: "", wantErr: ErrFormat},
+		{in: "bid buy 10 99.00", wantErr: ErrType},
+		{in: "limit hold 10 99.00", wantErr: ErrSide},
+		{in: "market na 10 0.00", wantErr: ErrSide},
+		{in: "limit buy 0 99.00", wantErr: ErrVolume},
+		{in: "limit buy -5 99.00", wantErr: ErrVolume},
+		{in: "limit buy 1.5 99.00", wantErr: ErrVolume},
+		{in: "cancel na 0 0.00", wantErr: ErrOrderNumber},
+		{in: "cancel na x 0.00", wantErr: ErrOrderNumber},
+		{in: "limit buy 10 0.00", wantErr: ErrPrice},
+		{in: "stop sell 10 -1.00", wantErr: ErrPrice},
+		{in: "limit buy 10 NaN", wantErr: ErrPrice},
+		{in: "limit buy 10 99.495", wantErr: ErrPrice},
+		{in: "market buy 10 free", wantErr: ErrPrice},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.in, func(t *testing.T) {
+			got, err := ParseOrder(tc.in)
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("got error %v; want %v", err, tc.wantErr)
+				}
+				if _, ok := err.(*ParseError); !ok {
+					t.Errorf("got error of type %T; want *ParseError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %v; want nil", err)
+			}
+			if *got != tc.want {
+				t.Errorf("got %+v; want %+v", *got, tc.want)
+			}
+		})
+	}
+}
+
+func TestOrder_Line(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"market buy 1000 0.0", "market buy 1000 0.00"},
+		{"limit sell 10 55.0 fok sym=AAPL", "limit sell 10 55.00 sym=AAPL fok"},
+		{"limit buy 10 99.00 post", "limit buy 10 99.00 post"},
+		{"stop sell 3 99.49", "stop sell 3 99.49"},
+		{"stoplimit buy 10 101.00 101.50 ioc", "stoplimit buy 10 101.00 101.50 ioc"},
+		{"cancel na 2 0.00", "cancel na 2 0"},
+		{"modify na 3 99.50 20", "modify na 3 99.50 20"},
+		{"limit buy 10 99.00 time=60 post", "limit buy 10 99.00 post time=60"},
+		{"stoplimit sell 10 99.00 98.50 peak=2", "stoplimit sell 10 99.00 98.50 peak=2"},
+		{"stop buy 5 101.00 day", "stop buy 5 101.00 day"},
+		{"limit sell 5 100.00 time=60 gtt=120 post", "limit sell 5 100.00 gtt=120 post time=60"},
+	}
+	for _, tc := range cases {
+		order := newOrder(tc.in)
+		got := order.Line()
+		if got != tc.want {
+			t.Errorf("%q: got %q; want %q", tc.in, got, tc.want)
+		}
+		if parsed := newOrder(got); *parsed != *order {
+			t.Errorf("%q: got %+v after parsing Line(); want %+v", tc.in, *parsed, *order)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	in := strings.Join([]string{
+		"limit buy 10 99.00",
+		"limit buy 0 99.00",
+		"",
+		"limit sell 5 98.00",
+		"limit sell ten 98.00",
+	}, "\n")
+
+	w, errw := &bytes.Buffer{}, &bytes.Buffer{}
+	if err := run(newExchange(), strings.NewReader(in), w, errw, false); err != nil {
+		t.Fatalf("run() got error %v; want nil", err)
+	}
+	if got, want := w.String(), "match 2 1 5 99.00\n"; !strings.Contains(got, want) {
+		t.Errorf("got output %q; want it to contain %q", got, want)
+	}
+	for _, want := range []string{"line 2: ", "line 5: "} {
+		if !strings.Contains(errw.String(), want) {
+			t.Errorf("got errors %q; want it to contain %q", errw, want)
+		}
+	}
+
+	err := run(newExchange(), strings.NewReader(in), &bytes.Buffer{}, &bytes.Buffer{}, true)
+	if !errors.Is(err, ErrVolume) || !strings.HasPrefix(err.Error(), "line 2: ") {
+		t.Errorf("run() in strict mode got error %v; want line 2 to fail with %v", err, ErrVolume)
+	}
+}
+
+func TestOrderBook_PartialFill(t *testing.T) {
+	book := newOrderBook()
+	maker := newOrder("limit buy 10 99.00")
+	book.Add(maker)
+	taker := newOrder("limit sell 4 98.00")
+	book.Add(taker)
+	taker2 := newOrder("market sell 20 0.00")
+	book.Add(taker2)
+
+	cases := []struct {
+		order          *Order
+		wantRemaining  Volume
+		wantFilled     Volume
+		wantExecuted   bool
+		wantStringPart string
+	}{
+		{maker, 0, 10, true, "to buy 10 units <= $99.00, with 0 remaining"},
+		{taker, 0, 4, true, "to sell 4 units >= $98.00, with 0 remaining"},
+		{taker2, 14, 6, false, "to sell 20 units at market price, with 14 remaining"},
+	}
+	for _, tc := range cases {
+		if tc.order.Remaining != tc.wantRemaining {
+			t.Errorf("%v: got Remaining %v; want %v", tc.order, tc.order.Remaining, tc.wantRemaining)
+		}
+		if got := tc.order.Filled(); got != tc.wantFilled {
+			t.Errorf("%v: got Filled() %v; want %v", tc.order, got, tc.wantFilled)
+		}
+		if tc.order.executed != tc.wantExecuted {
+			t.Errorf("%v: got executed %v; want %v", tc.order, tc.order.executed, tc.wantExecuted)
+		}
+		if !strings.Contains(tc.order.String(), tc.wantStringPart) {
+			t.Errorf("got %q; want it to contain %q", tc.order, tc.wantStringPart)
+		}
+	}
+}
+
+func TestOrderBook_Iceberg(t *testing.T) {
+	book := newOrderBook()
+	addAll(&book, "limit sell 10 100.00 peak=4", "limit sell 2 100.00", "market buy 5 0.00")
+	iceberg := book.orders[1]
+	if iceberg.Remaining != 6 || iceberg.Displayed() != 4 {
+		t.Errorf("got %v remaining and %v displayed; want 6 and 4", iceberg.Remaining, iceberg.Displayed())
+	}
+	want := "[id 1] limit iceberg (peak 4) order to sell 10 units >= $100.00, with 6 remaining, 4 displayed"
+	if got := iceberg.String(); got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	// The replenished part of the iceberg order goes behind order 2.
+	if got := book.sellOrders.best().front().id; got != 2 {
+		t.Errorf("got order %v first in queue; want 2", got)
+	}
+	if got, want := book.Snapshot().Asks, []Level{{10000, 5, 2}}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got asks %v; want %v", got, want)
+	}
+}
+
+func TestOrderBook_Cancel(t *testing.T) {
+	cases := []struct {
+		desc string
+		in   []string
+		want []string
+	}{
+		{
+			desc: "resting limit order",
+			in: []string{
+				"limit buy 10 99.00",
+				"cancel na 1 0.00",
+				"market sell 5 0.00",
+			},
+			want: []string{},
+		},
+		{
+			desc: "partially executed order",
+			in: []string{
+				"limit buy 10 99.00",
+				"limit buy 10 98.00",
+				"market sell 4 0.00",
+				"cancel na 1 0.00",
+				"market sell 8 0.00",
+			},
+			want: []string{
+				"match 3 1 4 99.00",
+				"match 5 2 8 98.00",
+			},
+		},
+		{
+			desc: "stop order",
+			in: []string{
+				"limit buy 10 99.00",
+				"stop sell 5 100.00",
+				"cancel na 2 0.00",
+				"market sell 1 0.00",
+			},
+			want: []string{
+				"match 4 1 1 99.00",
+			},
+		},
+		{
+			desc: "unknown, executed and cancelled orders",
+			in: []string{
+				"limit buy 10 99.00",
+				"limit sell 10 99.00",
+				"limit buy 5 98.00",
+				"cancel na 2 0.00",
+				"cancel na 3 0.00",
+				"cancel na 3 0.00",
+				"cancel na 42 0.00",
+				"limit sell 5 98.00",
+			},
+			want: []string{
+				"match 2 1 10 99.00",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			book := newOrderBook()
+			got := addAll(&book, tc.in...)
+			if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+				t.Errorf("got %q; want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestOrderBook_Stops(t *testing.T) {
+	cases := []struct {
+		desc string
+		in   []string
+		want []string
+	}{
+		{
+			desc: "triggered by last trade price",
+			in: []string{
+				"limit buy 10 99.00",
+				"limit buy 15 100.00",
+				"limit buy 3 100.50",
+				"limit sell 5 100.00",
+				"limit buy 5 99.50",
+				"stop sell 3 99.49",
+				"cancel na 2 0.00",
+				"market sell 6 0.00",
+			},
+			want: []string{
+				"match 4 3 3 100.50",
+				"match 4 2 2 100.00",
+				"match 8 5 5 99.50",
+				"match 8 1 1 99.00",
+				"match 6 1 3 99.00",
+			},
+		},
+		{
+			desc: "oldest first",
+			in: []string{
+				"limit buy 5 97.00",
+				"stop sell 1 98.00",
+				"stop sell 1 99.00",
+				"market sell 1 0.00",
+			},
+			want: []string{
+				"match 4 1 1 97.00",
+				"match 2 1 1 97.00",
+				"match 3 1 1 97.00",
+			},
+		},
+		{
+			desc: "buy stops at threshold",
+			in: []string{
+				"limit sell 5 101.00",
+				"stop buy 2 101.00",
+				"stop buy 2 102.00",
+				"market buy 1 0.00",
+			},
+			want: []string{
+				"match 4 1 1 101.00",
+				"match 2 1 2 101.00",
+			},
+		},
+		{
+			desc: "cascade",
+			in: []string{
+				"limit buy 1 99.00",
+				"limit buy 5 97.00",
+				"stop sell 1 99.00",
+				"stop sell 1 98.00",
+				"market sell 1 0.00",
+			},
+			want: []string{
+				"match 5 1 1 99.00",
+				"match 3 2 1 97.00",
+				"match 4 2 1 97.00",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			book := newOrderBook()
+			got := addAll(&book, tc.in...)
+			if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+				t.Errorf("got %q; want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// orderMix is the relative frequency of each OrderType in random orders.
+type orderMix map[OrderType]int
+
+// randomOrders returns n random valid orders, with types picked according
+// to mix and prices within spread ticks of 100.00.
+//
+// Cancel orders refer to a random earlier order.
+func randomOrders(r *rand.Rand, n int, mix orderMix, spread int64) []*Order {
+	total := 0
+	types := []OrderType{Market, Limit, Stop, Cancel}
+	for _, ot := range types {
+		total += mix[ot]
+	}
+	orders := make([]*Order, n)
+	for i := range orders {
+		pick := r.Intn(total)
+		ot := types[0]
+		for _, ot = range types {
+			if pick < mix[ot] {
+				break
+			}
+			pick -= mix[ot]
+		}
+		order := &Order{Type: ot}
+		if ot == Cancel {
+			order.ToCancel = OrderNumber(r.Intn(i+1) + 1)
+		} else {
+			order.Side = BuySide
+			if r.Intn(2) == 0 {
+				order.Side = SellSide
+			}
+			order.Volume = Volume(r.Intn(100) + 1)
+			order.Remaining = order.Volume
+		}
+		if ot == Limit || ot == Stop {
+			order.Limit = Price(10000 + r.Int63n(2*spread+1) - spread)
+		}
+		orders[i] = order
+	}
+	return orders
+}
+
 func BenchmarkExecute(b *testing.B) {
 	benchmarks := []struct {
-		name    string
-		float   float64
-		fmt     byte
-		prec    int
-		bitSize int
+		name   string
+		mix    orderMix
+		spread int64
 	}{
-		{"Decimal", 33909, 'g', -1, 64},
-		{"Float", 339.7784, 'g', -1, 64},
+		{"Limit", orderMix{Limit: 1}, 100},
+		{"Mixed", orderMix{Market: 10, Limit: 60, Stop: 10, Cancel: 20}, 100},
+		{"WideSpread", orderMix{Market: 10, Limit: 60, Stop: 10, Cancel: 20}, 5000},
 	}
 	for _, bm := range benchmarks {
 		b.Run(bm.name, func(b *testing.B) {
-			for i := 0; i < b.N; i++ {
-				// TODO: Benchmark order execution:
-				// AppendFloat(dst[:0], bm.float, bm.fmt, bm.prec, bm.bitSize)
+			orders := randomOrders(rand.New(rand.NewSource(1)), b.N, bm.mix, bm.spread)
+			book := newOrderBook()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for _, order := range orders {
+				matches, _ := book.Add(order)
+				book.getTriggeredStops(matches)
 			}
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "orders/s")
 		})
 	}
 }
+
+// BenchmarkDeepLevel executes b.N one-lot orders against as many orders
+// resting at a single price, so the cost of each match must not grow
+// with the size of the level.
+func BenchmarkDeepLevel(b *testing.B) {
+	book := newOrderBook()
+	for i := 0; i < b.N; i++ {
+		book.Add(newOrder("limit sell 1 100.00"))
+	}
+	takers := make([]*Order, b.N)
+	for i := range takers {
+		takers[i] = newOrder("market buy 1 0.00")
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for _, order := range takers {
+		book.Add(order)
+	}
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "orders/s")
+}
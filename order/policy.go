@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+type (
+	// MatchingPolicy decides how an incoming order is shared among the
+	// resting orders at a price level.
+	MatchingPolicy interface {
+		// Allocate returns the number of units that each order at a
+		// level trades, out of volume units. sizes holds the units that
+		// each order displays, oldest first, and volume is at most their
+		// total.
+		//
+		// The allocations must add up to volume, and each must be at
+		// most the size of its order.
+		Allocate(sizes []Volume, volume Volume) []Volume
+	}
+
+	// FIFO is the MatchingPolicy giving all volume to the oldest orders
+	// first. It is the default.
+	FIFO struct{}
+
+	// ProRata is the MatchingPolicy sharing volume among orders in
+	// proportion to their size, rounded down.
+	//
+	// Orders whose share is less than MinAllocation get nothing. What is
+	// left after rounding and dropping small shares goes to the oldest
+	// orders first.
+	ProRata struct {
+		MinAllocation Volume
+	}
+)
+
+// Allocate fills the oldest orders first.
+func (FIFO) Allocate(sizes []Volume, volume Volume) []Volume {
+	alloc := make([]Volume, len(sizes))
+	fillOldest(sizes, alloc, volume)
+	return alloc
+}
+
+// Allocate shares volume among orders in proportion to their size.
+func (p ProRata) Allocate(sizes []Volume, volume Volume) []Volume {
+	total := Volume(0)
+	for _, size := range sizes {
+		total += size
+	}
+	alloc := make([]Volume, len(sizes))
+	left := volume
+	for i, size := range sizes {
+		// The product takes 128 bits, and since volume is at most total
+		// the share fits in 64.
+		hi, lo := bits.Mul64(uint64(volume), uint64(size))
+		quo, _ := bits.Div64(hi, lo, uint64(total))
+		share := Volume(quo)
+		if share < p.MinAllocation {
+			continue
+		}
+		alloc[i] = share
+		left -= share
+	}
+	fillOldest(sizes, alloc, left)
+	return alloc
+}
+
+// fillOldest adds volume to alloc, giving each order up to its size,
+// oldest first.
+func fillOldest(sizes []Volume, alloc []Volume, volume Volume) {
+	for i, size := range sizes {
+		if volume == 0 {
+			return
+		}
+		extra := size - alloc[i]
+		if extra > volume {
+			extra = volume
+		}
+		alloc[i] += extra
+		volume -= extra
+	}
+}
+
+// parseSymbols returns the symbols listed in s, separated by commas,
+// with "-" standing for the default instrument.
+func parseSymbols(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	symbols := []string{}
+	for _, symbol := range strings.Split(s, ",") {
+		if symbol == "-" {
+			symbol = ""
+		} else if !validSymbol(symbol) {
+			return nil, fmt.Errorf("invalid symbol %q", symbol)
+		}
+		symbols = append(symbols, symbol)
+	}
+	return symbols, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestMatchingPolicy_Allocate(t *testing.T) {
+	cases := []struct {
+		policy MatchingPolicy
+		sizes  []Volume
+		volume Volume
+		want   []Volume
+	}{
+		{FIFO{}, []Volume{5, 10, 5}, 12, []Volume{5, 7, 0}},
+		{FIFO{}, []Volume{5, 10, 5}, 20, []Volume{5, 10, 5}},
+		{ProRata{}, []Volume{10, 30, 60}, 50, []Volume{5, 15, 30}},
+		// 10 * 1/3 rounds down to 3, and the remainder goes to the oldest.
+		{ProRata{}, []Volume{5, 5, 5}, 10, []Volume{4, 3, 3}},
+		{ProRata{}, []Volume{1, 1, 98}, 10, []Volume{1, 0, 9}},
+		// Shares below the minimum are dropped, and their volume goes to
+		// the oldest orders with room for it.
+		{ProRata{MinAllocation: 2}, []Volume{1, 10, 89}, 10, []Volume{1, 1, 8}},
+		{ProRata{MinAllocation: 5}, []Volume{20, 20, 20}, 12, []Volume{12, 0, 0}},
+		// Shares are exact for sizes whose products overflow 64 bits.
+		{ProRata{}, []Volume{1 << 40, 1 << 40}, 1 << 40, []Volume{1 << 39, 1 << 39}},
+		{ProRata{}, []Volume{1 << 61, 3 << 61}, 1<<61 + 3, []Volume{1<<59 + 1, 3<<59 + 2}},
+	}
+	for _, tc := range cases {
+		got := tc.policy.Allocate(tc.sizes, tc.volume)
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%T%+v.Allocate(%v, %v): got %v; want %v", tc.policy, tc.policy, tc.sizes, tc.volume, got, tc.want)
+		}
+	}
+}
+
+func TestOrderBook_ProRata(t *testing.T) {
+	book := newOrderBook()
+	book.policy = ProRata{MinAllocation: 2}
+	got := addAll(&book,
+		"limit sell 10 99.00",
+		"limit sell 30 99.00",
+		"limit sell 5 99.50",
+		"limit buy 20 99.00",
+		"market buy 30 0.00",
+	)
+	want := []string{
+		"match 4 1 5 99.00",
+		"match 4 2 15 99.00",
+		"match 5 1 5 99.00",
+		"match 5 2 15 99.00",
+		"match 5 3 5 99.50",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got matches (-want +got):\n%s", diffLines(strings.Join(got, "\n"), strings.Join(want, "\n")))
+	}
+}
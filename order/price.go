@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// tickSize is the smallest increment of a Price.
+//
+// The tick size is units / 10^decimals, e.g. 0.05 is 5 / 10^2.
+type tickSize struct {
+	units    int64
+	decimals int
+}
+
+// tick is the tick size that Price values are counted in.
+var tick = tickSize{units: 1, decimals: 2}
+
+// maxDecimals is the most decimal places supported in prices and tick sizes.
+const maxDecimals = 8
+
+var (
+	// errDecimal is the error for strings that aren't plain decimal numbers.
+	errDecimal = errors.New("not a decimal number")
+	// errOffTick is the error for prices that aren't a multiple of the tick size.
+	errOffTick = errors.New("not a multiple of the tick size")
+)
+
+// parseDecimal returns s as an integer number of 10^-decimals units.
+//
+// An error is returned if s is not a decimal number such as "99.50", or if
+// it can't be represented exactly with the given number of decimals.
+func parseDecimal(s string, decimals int) (int64, error) {
+	digits := strings.TrimPrefix(s, "-")
+	neg := len(digits) < len(s)
+	whole, frac, _ := strings.Cut(digits, ".")
+	if whole == "" && frac == "" {
+		return 0, errDecimal
+	}
+	for _, c := range whole + frac {
+		if c < '0' || c > '9' {
+			return 0, errDecimal
+		}
+	}
+	if len(frac) > decimals {
+		if strings.Trim(frac[decimals:], "0") != "" {
+			return 0, errOffTick
+		}
+		frac = frac[:decimals]
+	}
+	frac += strings.Repeat("0", decimals-len(frac))
+	units, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errDecimal, err)
+	}
+	if neg {
+		units = -units
+	}
+	return units, nil
+}
+
+// SetTickSize sets the tick size that prices are counted in, e.g. "0.01".
+//
+// SetTickSize must be called before any prices are parsed.
+func SetTickSize(s string) error {
+	_, frac, _ := strings.Cut(s, ".")
+	decimals := len(strings.TrimRight(frac, "0"))
+	if decimals > maxDecimals {
+		return fmt.Errorf("tick size %q has more than %d decimals", s, maxDecimals)
+	}
+	units, err := parseDecimal(s, decimals)
+	if err != nil {
+		return fmt.Errorf("invalid tick size %q: %v", s, err)
+	}
+	if units <= 0 {
+		return fmt.Errorf("invalid tick size %q: must be positive", s)
+	}
+	tick = tickSize{units: units, decimals: decimals}
+	return nil
+}
+
+// ParsePrice returns the Price for a decimal string such as "99.50".
+//
+// An error is returned if s is not a decimal number, or if it is not a
+// multiple of the tick size.
+func ParsePrice(s string) (Price, error) {
+	units, err := parseDecimal(s, tick.decimals)
+	if err != nil {
+		return 0, err
+	}
+	if units%tick.units != 0 {
+		return 0, errOffTick
+	}
+	return Price(units / tick.units), nil
+}
+
+// String returns a readable representation of the Price, with at least
+// two decimals.
+func (p Price) String() string {
+	units := int64(p) * tick.units
+	sign := ""
+	if units < 0 {
+		sign = "-"
+		units = -units
+	}
+	s := strconv.FormatInt(units, 10)
+	if len(s) <= tick.decimals {
+		s = strings.Repeat("0", tick.decimals-len(s)+1) + s
+	}
+	whole, frac := s[:len(s)-tick.decimals], s[len(s)-tick.decimals:]
+	if len(frac) < 2 {
+		frac += strings.Repeat("0", 2-len(frac))
+	}
+	return sign + whole + "." + frac
+}
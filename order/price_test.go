@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+// withTickSize runs fn with the tick size set to s.
+func withTickSize(t *testing.T, s string, fn func()) {
+	old := tick
+	defer func() { tick = old }()
+	if err := SetTickSize(s); err != nil {
+		t.Fatalf("SetTickSize(%q) got error %v", s, err)
+	}
+	fn()
+}
+
+func TestParsePrice(t *testing.T) {
+	cases := []struct {
+		tick    string
+		in      string
+		want    Price
+		wantStr string
+		wantErr error
+	}{
+		{tick: "0.01", in: "99.49", want: 9949, wantStr: "99.49"},
+		{tick: "0.01", in: "99.50", want: 9950, wantStr: "99.50"},
+		{tick: "0.01", in: "99.5", want: 9950, wantStr: "99.50"},
+		{tick: "0.01", in: "100", want: 10000, wantStr: "100.00"},
+		{tick: "0.01", in: "0.07", want: 7, wantStr: "0.07"},
+		{tick: "0.01", in: "99.4900", want: 9949, wantStr: "99.49"},
+		{tick: "0.01", in: "-1.25", want: -125, wantStr: "-1.25"},
+		{tick: "0.01", in: "99.495", wantErr: errOffTick},
+		{tick: "0.01", in: "1e5", wantErr: errDecimal},
+		{tick: "0.01", in: "NaN", wantErr: errDecimal},
+		{tick: "0.01", in: ".", wantErr: errDecimal},
+		{tick: "0.01", in: "99999999999999999999", wantErr: errDecimal},
+		{tick: "0.05", in: "99.45", want: 1989, wantStr: "99.45"},
+		{tick: "0.05", in: "99.47", wantErr: errOffTick},
+		{tick: "0.001", in: "99.495", want: 99495, wantStr: "99.495"},
+		{tick: "1", in: "99", want: 99, wantStr: "99.00"},
+		{tick: "1", in: "99.50", wantErr: errOffTick},
+		{tick: "0.25", in: "0.75", want: 3, wantStr: "0.75"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.tick+"/"+tc.in, func(t *testing.T) {
+			withTickSize(t, tc.tick, func() {
+				got, err := ParsePrice(tc.in)
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("got error %v; want %v", err, tc.wantErr)
+				}
+				if err != nil {
+					return
+				}
+				if got != tc.want {
+					t.Errorf("got %d ticks; want %d", got, tc.want)
+				}
+				if got.String() != tc.wantStr {
+					t.Errorf("got %q; want %q", got.String(), tc.wantStr)
+				}
+			})
+		})
+	}
+}
+
+func TestSetTickSize(t *testing.T) {
+	for _, in := range []string{"0", "-0.01", "abc", "0.000000001", ""} {
+		old := tick
+		if err := SetTickSize(in); err == nil {
+			t.Errorf("SetTickSize(%q) got nil error; want error", in)
+		}
+		tick = old
+	}
+}
+
+// TestRun_testTxt checks that input.txt produces the output in test.txt.
+func TestRun_testTxt(t *testing.T) {
+	in, err := os.ReadFile("input.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile("test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, wantOut, _ := strings.Cut(string(want), "Output:\n")
+
+	w := &bytes.Buffer{}
+	if err := run(newExchange(), bytes.NewReader(in), w, &bytes.Buffer{}, true); err != nil {
+		t.Fatalf("run() got error %v", err)
+	}
+	if got := w.String(); strings.TrimSpace(got) != strings.TrimSpace(wantOut) {
+		t.Errorf("got output\n%s\nwant\n%s", got, wantOut)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// randomStream returns n random valid lines for an OrderBook: orders of
+// every type and option, with prices within spread ticks of 100.00, and
+// the "auction" and "uncross" commands. Orders other than Cancel and
+// Modify orders may belong to one of two accounts.
+//
+// Cancel and Modify orders refer to a random earlier order.
+func randomStream(r *rand.Rand, n int, spread int64) []string {
+	price := func() Price {
+		return Price(10000 + r.Int63n(2*spread+1) - spread)
+	}
+	side := func() OrderSide {
+		if r.Intn(2) == 0 {
+			return SellSide
+		}
+		return BuySide
+	}
+	lines := make([]string, n)
+	auction := false
+	for i := range lines {
+		volume := r.Intn(20) + 1
+		var line string
+		pick := r.Intn(100)
+		switch {
+		case pick < 10:
+			line = fmt.Sprintf("market %v %v 0.00", side(), volume)
+		case pick < 50:
+			line = fmt.Sprintf("limit %v %v %v", side(), volume, price())
+			switch r.Intn(8) {
+			case 0:
+				line += " ioc"
+			case 1:
+				line += " fok"
+			case 2:
+				line += " post"
+			case 3:
+				line += fmt.Sprintf(" peak=%v", r.Intn(volume)+1)
+			}
+		case pick < 60:
+			line = fmt.Sprintf("stop %v %v %v", side(), volume, price())
+		case pick < 70:
+			line = fmt.Sprintf("stoplimit %v %v %v %v", side(), volume, price(), price())
+		case pick < 85:
+			line = fmt.Sprintf("cancel na %v 0.00", r.Intn(i+1)+1)
+		case pick < 97:
+			line = fmt.Sprintf("modify na %v %v %v", r.Intn(i+1)+1, price(), volume)
+		case auction:
+			line = "uncross"
+			auction = false
+		default:
+			line = "auction"
+			auction = true
+		}
+		if pick < 70 && r.Intn(2) == 0 {
+			line += fmt.Sprintf(" acct=%c", 'a'+r.Intn(2))
+		}
+		lines[i] = line
+	}
+	return lines
+}
+
+// bookChecker checks the invariants of an OrderBook as lines are added
+// to it.
+type bookChecker struct {
+	book *OrderBook
+	// orders holds each Order added to the book, other than Cancel and
+	// Modify orders.
+	orders []*Order
+	// filled holds the number of units each Order has matched.
+	filled map[*Order]Volume
+}
+
+func newBookChecker(book *OrderBook) *bookChecker {
+	return &bookChecker{book: book, filled: map[*Order]Volume{}}
+}
+
+// add adds line to the book, as for randomStream, and returns an error
+// if any invariant is broken afterwards.
+func (c *bookChecker) add(line string) error {
+	// done holds the orders that were cancelled or executed, and
+	// untriggered the stop orders that were waiting, before line.
+	done, untriggered := map[*Order]bool{}, map[*Order]bool{}
+	for _, o := range c.orders {
+		done[o] = o.cancelled || o.executed
+		untriggered[o] = o.isStop() && !o.stopTriggered
+	}
+
+	var matches Matches
+	switch line {
+	case "auction":
+		c.book.auction = true
+	case "uncross":
+		matches = c.book.uncross()
+	default:
+		order, err := ParseOrder(line)
+		if err != nil {
+			return fmt.Errorf("invalid order: %v", err)
+		}
+		matches, err = c.book.Add(order)
+		if _, ok := err.(*Reject); err != nil && !ok {
+			return err
+		}
+		if order.Type != Cancel && order.Type != Modify {
+			c.orders = append(c.orders, order)
+		}
+	}
+	matches = append(matches, c.book.getTriggeredStops(matches)...)
+
+	for _, m := range matches {
+		if m.Volume <= 0 || m.Taker == m.Maker {
+			return fmt.Errorf("invalid match %v", m)
+		}
+		for _, o := range []*Order{m.Taker, m.Maker} {
+			if done[o] {
+				return fmt.Errorf("order %v matched after it was cancelled or executed: %v", o.id, m)
+			}
+			c.filled[o] += m.Volume
+			if c.filled[o] > o.Volume {
+				return fmt.Errorf("order %v filled %v of %v units", o.id, c.filled[o], o.Volume)
+			}
+			if o.Type != Market && o.Type != Stop && !o.crosses(m.Price) {
+				return fmt.Errorf("order %v traded through its limit: %v", o.id, m)
+			}
+		}
+	}
+	for _, o := range c.orders {
+		if o.Volume-o.Remaining != c.filled[o] {
+			return fmt.Errorf("order %v has %v units executed, but matched %v", o.id, o.Volume-o.Remaining, c.filled[o])
+		}
+	}
+	open := map[openKey]Volume{}
+	for id, o := range c.book.orders {
+		if o.id != id || o.cancelled || o.executed {
+			return fmt.Errorf("order %v resting after it was cancelled or executed", id)
+		}
+		if o.Account != "" {
+			open[openKey{o.Account, o.Side}] += o.Remaining
+		}
+	}
+	if fmt.Sprint(open) != fmt.Sprint(c.book.open) {
+		return fmt.Errorf("got open units %v; want %v", c.book.open, open)
+	}
+
+	if bid, ask := c.book.buyOrders.best(), c.book.sellOrders.best(); !c.book.auction && bid != nil && ask != nil && bid.price >= ask.price {
+		return fmt.Errorf("book crossed at %v bid, %v ask", bid.price, ask.price)
+	}
+
+	// Stop orders trigger at the first trade at or through their
+	// threshold, and execute in the order they trigger, oldest first.
+	triggeredBy := func(stop *Order, price Price) bool {
+		if stop.Side == BuySide {
+			return price >= stop.threshold()
+		}
+		return price <= stop.threshold()
+	}
+	for _, o := range c.book.orders {
+		if !o.isStop() || o.stopTriggered {
+			continue
+		}
+		for _, m := range matches {
+			if triggeredBy(o, m.Price) {
+				return fmt.Errorf("stop order %v not triggered by %v", o.id, m)
+			}
+		}
+	}
+	lastTrigger, lastID := -1, OrderNumber(0)
+	seen := map[*Order]bool{}
+	for i, m := range matches {
+		stop := m.Taker
+		if !untriggered[stop] || seen[stop] {
+			continue
+		}
+		seen[stop] = true
+		trigger := 0
+		for trigger < i && !triggeredBy(stop, matches[trigger].Price) {
+			trigger++
+		}
+		if trigger == i {
+			return fmt.Errorf("stop order %v executed before it was triggered: %v", stop.id, m)
+		}
+		if trigger < lastTrigger || trigger == lastTrigger && stop.id < lastID {
+			return fmt.Errorf("stop order %v executed after stop order %v, which triggered later", stop.id, lastID)
+		}
+		lastTrigger, lastID = trigger, stop.id
+	}
+	return nil
+}
+
+// checkStream adds lines to a new OrderBook with the SelfTradePolicy
+// stp, and reports the first broken invariant to t.
+func checkStream(t *testing.T, lines []string, stp SelfTradePolicy) {
+	t.Helper()
+	book := newOrderBook()
+	book.stp = stp
+	c := newBookChecker(&book)
+	for i, line := range lines {
+		if err := c.add(line); err != nil {
+			t.Fatalf("line %d %q: %v", i+1, line, err)
+		}
+	}
+}
+
+func TestOrderBook_invariants(t *testing.T) {
+	for seed := int64(1); seed <= 20; seed++ {
+		t.Run(fmt.Sprint(seed), func(t *testing.T) {
+			r := rand.New(rand.NewSource(seed))
+			checkStream(t, randomStream(r, 1000, 1+seed%20), SelfTradePolicy(seed%4))
+		})
+	}
+}
+
+func FuzzOrderBook(f *testing.F) {
+	f.Add(int64(1), uint16(100), uint8(5))
+	f.Add(int64(2), uint16(1000), uint8(50))
+	f.Fuzz(func(t *testing.T, seed int64, n uint16, spread uint8) {
+		r := rand.New(rand.NewSource(seed))
+		checkStream(t, randomStream(r, int(n%2000), int64(spread)), SelfTradePolicy(seed&3))
+	})
+}
+
+func FuzzParseOrder(f *testing.F) {
+	for _, in := range []string{
+		"market buy 1000 0.0",
+		"limit sell 10 99.00 fok sym=AAPL",
+		"limit buy 10 99.00 post peak=2 acct=A time=60",
+		"stop sell 5 99.49 gtt=120",
+		"stoplimit buy 10 101.00 101.50 ioc",
+		"cancel na 2 0.00",
+		"modify na 3 99.50 20 day",
+		"limit buy 1.5 NaN",
+	} {
+		f.Add(in)
+	}
+	f.Fuzz(func(t *testing.T, in string) {
+		order, err := ParseOrder(in)
+		if err != nil {
+			if _, ok := err.(*ParseError); !ok {
+				t.Fatalf("ParseOrder(%q) got error of type %T; want *ParseError", in, err)
+			}
+			return
+		}
+		line := order.Line()
+		parsed, err := ParseOrder(line)
+		if err != nil {
+			t.Fatalf("ParseOrder(%q) got error %v for Line() of %q", line, err, in)
+		}
+		if *parsed != *order {
+			t.Errorf("ParseOrder(%q) got %+v; want %+v from %q", line, *parsed, *order, in)
+		}
+	})
+}
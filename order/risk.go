@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+type (
+	// RiskCheck is a pre-trade check of the orders added to an Exchange.
+	RiskCheck interface {
+		// Check returns why order must be rejected before it is added to
+		// book, or "" if it may be added.
+		Check(ex *Exchange, book *OrderBook, order *Order) string
+	}
+
+	// MaxOrderSize rejects orders for more units than its Volume.
+	MaxOrderSize struct {
+		Volume Volume
+	}
+
+	// MaxNotional rejects orders that could trade for more than its
+	// Notional, as a number of ticks.
+	//
+	// The notional of a Market order is what it would cost to execute it
+	// against the book right away.
+	MaxNotional struct {
+		Notional Price
+	}
+
+	// PriceBand rejects orders priced more than Percent percent away
+	// from the last trade in the book. Any price is accepted before the
+	// first trade.
+	PriceBand struct {
+		Percent int64
+	}
+
+	// PositionLimit rejects orders that could take the position of their
+	// Account in the symbol beyond Limit units long or short, if they
+	// and the other open orders of the Account on the same side were
+	// executed.
+	PositionLimit struct {
+		Limit int64
+	}
+)
+
+// Check rejects orders larger than the MaxOrderSize.
+func (c MaxOrderSize) Check(ex *Exchange, book *OrderBook, order *Order) string {
+	if order.Volume > c.Volume {
+		return fmt.Sprintf("size %v exceeds max %v", order.Volume, c.Volume)
+	}
+	return ""
+}
+
+// Check rejects orders with a notional above the MaxNotional.
+func (c MaxNotional) Check(ex *Exchange, book *OrderBook, order *Order) string {
+	notional, ok := notional(order.Limit, order.Volume)
+	if order.Type == Market {
+		notional, ok = book.sweepCost(order)
+	}
+	if !ok {
+		return fmt.Sprintf("notional exceeds max %v", c.Notional)
+	}
+	if notional > c.Notional {
+		return fmt.Sprintf("notional %v exceeds max %v", notional, c.Notional)
+	}
+	return ""
+}
+
+// Check rejects orders with a limit outside the PriceBand.
+func (c PriceBand) Check(ex *Exchange, book *OrderBook, order *Order) string {
+	if book.last == 0 || (order.Type != Limit && order.Type != StopLimit && order.Type != Modify) {
+		return ""
+	}
+	band := book.last * Price(c.Percent) / 100
+	if order.Limit < book.last-band || order.Limit > book.last+band {
+		return fmt.Sprintf("price %v outside %d%% band around %v", order.Limit, c.Percent, book.last)
+	}
+	return ""
+}
+
+// Check rejects orders that could breach the PositionLimit.
+//
+// Modify orders that raise the size of an order are checked for the
+// units they add to it.
+func (c PositionLimit) Check(ex *Exchange, book *OrderBook, order *Order) string {
+	account, side, volume := order.Account, order.Side, order.Volume
+	if order.Type == Modify {
+		target, ok := book.orders[order.ToModify]
+		if !ok || order.Volume <= target.Volume {
+			return ""
+		}
+		account, side, volume = target.Account, target.Side, order.Volume-target.Volume
+	}
+	if account == "" {
+		return ""
+	}
+	position := int64(0)
+	if acct, ok := ex.accounts[account]; ok {
+		position = acct.Positions[book.symbol]
+	}
+	volume += book.open[openKey{account, side}]
+	if side == BuySide {
+		position += int64(volume)
+	} else {
+		position -= int64(volume)
+	}
+	if position > c.Limit || position < -c.Limit {
+		return fmt.Sprintf("position %d exceeds limit %d", position, c.Limit)
+	}
+	return ""
+}
+
+// riskChecks returns the risk checks set by flags.
+func riskChecks() ([]RiskCheck, error) {
+	checks := []RiskCheck{}
+	if *maxSize > 0 {
+		checks = append(checks, MaxOrderSize{Volume(*maxSize)})
+	}
+	if *maxNotional != "" {
+		notional, err := ParsePrice(*maxNotional)
+		if err != nil || notional <= 0 {
+			return nil, fmt.Errorf("invalid -max_notional %q", *maxNotional)
+		}
+		checks = append(checks, MaxNotional{notional})
+	}
+	if *priceBand > 0 {
+		checks = append(checks, PriceBand{*priceBand})
+	}
+	if *maxPosition > 0 {
+		checks = append(checks, PositionLimit{*maxPosition})
+	}
+	return checks, nil
+}
+
+// check runs the risk checks of the Exchange for order, and returns why
+// it must be rejected, or "" if it may be added to book.
+//
+// Cancel orders are never rejected.
+func (ex *Exchange) check(book *OrderBook, order *Order) string {
+	if order.Type == Cancel {
+		return ""
+	}
+	for _, c := range ex.risk {
+		if reason := c.Check(ex, book, order); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+// notional returns the cost of volume units at price, and false if it
+// is too large for a Price.
+func notional(price Price, volume Volume) (Price, bool) {
+	abs := uint64(price)
+	if price < 0 {
+		abs = uint64(-price)
+	}
+	hi, lo := bits.Mul64(abs, uint64(volume))
+	if hi != 0 || lo > math.MaxInt64 {
+		return 0, false
+	}
+	if price < 0 {
+		return -Price(lo), true
+	}
+	return Price(lo), true
+}
+
+// sweepCost returns what it would cost to execute taker right away
+// against the resting orders in the book, up to its Remaining units,
+// and false if the cost is too large for a Price.
+func (book *OrderBook) sweepCost(taker *Order) (Price, bool) {
+	cost, ok := Price(0), true
+	left := taker.Remaining
+	book.opposite(taker.Side).each(func(level *priceLevel) bool {
+		if !taker.crosses(level.price) {
+			return false
+		}
+		return level.each(func(maker *Order) bool {
+			volume := maker.Remaining
+			if volume > left {
+				volume = left
+			}
+			var n Price
+			n, ok = notional(level.price, volume)
+			if !ok || n > 0 && cost > math.MaxInt64-n || n < 0 && cost < math.MinInt64-n {
+				ok = false
+				return false
+			}
+			cost += n
+			left -= volume
+			return left > 0
+		})
+	})
+	return cost, ok
+}
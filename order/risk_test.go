@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExchange_risk(t *testing.T) {
+	setup := []string{
+		"limit sell 5 100.00",
+		"limit sell 5 101.00 acct=bob",
+		"limit buy 1 100.00 acct=alice",
+	}
+	cases := []struct {
+		desc  string
+		check RiskCheck
+		in    string
+		want  string
+	}{
+		{"size", MaxOrderSize{100}, "market buy 1000000000 0.0", "reject 4 size 1000000000 exceeds max 100"},
+		{"size ok", MaxOrderSize{100}, "limit buy 100 90.00", ""},
+		{"size modify", MaxOrderSize{100}, "modify na 1 100.00 101", "reject 4 size 101 exceeds max 100"},
+		{"notional", MaxNotional{50000}, "limit buy 6 99.00", "reject 4 notional 594.00 exceeds max 500.00"},
+		{"notional market", MaxNotional{50000}, "market buy 6 0.00", "reject 4 notional 602.00 exceeds max 500.00"},
+		{"notional market ok", MaxNotional{50000}, "market buy 4 0.00", "match 4 1 4 100.00"},
+		{"notional overflow", MaxNotional{100000}, "limit buy 69175290276410818 2.00", "reject 4 notional exceeds max 1000.00"},
+		{"band", PriceBand{10}, "limit sell 1 89.99", "reject 4 price 89.99 outside 10% band around 100.00"},
+		{"band ok", PriceBand{10}, "limit sell 1 90.00", ""},
+		{"band market", PriceBand{10}, "market buy 1 0.00", "match 4 1 1 100.00"},
+		{"position", PositionLimit{5}, "limit buy 5 99.00 acct=alice", "reject 4 position 6 exceeds limit 5"},
+		{"position short", PositionLimit{5}, "limit sell 6 110.00 acct=alice", ""},
+		{"position other", PositionLimit{5}, "limit buy 5 99.00 acct=bob", ""},
+		{"position modify", PositionLimit{5}, "modify na 2 101.00 6", "reject 4 position -6 exceeds limit 5"},
+		{"position modify same size", PositionLimit{4}, "modify na 2 101.00 5", ""},
+		{"cancel", MaxOrderSize{0}, "cancel na 1 0", ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			ex := newExchange()
+			if err := run(ex, strings.NewReader(strings.Join(setup, "\n")), &bytes.Buffer{}, &bytes.Buffer{}, true); err != nil {
+				t.Fatalf("run() got error %v", err)
+			}
+			ex.risk = []RiskCheck{tc.check}
+			w := &bytes.Buffer{}
+			if err := run(ex, strings.NewReader(tc.in), w, &bytes.Buffer{}, true); err != nil {
+				t.Fatalf("run() got error %v", err)
+			}
+			if got := strings.TrimSuffix(w.String(), "\n"); got != tc.want {
+				t.Errorf("%q: got %q; want %q", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestOrderBook_sweepCost(t *testing.T) {
+	book := newOrderBook()
+	addAll(&book, "limit sell 30000000000000000 1.50", "limit sell 30000000000000000 1.60")
+	if got, ok := book.sweepCost(newOrder("market buy 30000000000000001 0.00")); got != 4500000000000000160 || !ok {
+		t.Errorf("got %v, %v; want 45000000000000001.60, true", got, ok)
+	}
+	// The cost of both levels overflows a Price.
+	if _, ok := book.sweepCost(newOrder("market buy 60000000000000000 0.00")); ok {
+		t.Errorf("got ok for an overflowing cost; want false")
+	}
+}
+
+func TestExchange_positionLimitOpenOrders(t *testing.T) {
+	ex := newExchange()
+	ex.risk = []RiskCheck{PositionLimit{10}}
+	in := strings.Join([]string{
+		"limit buy 8 99.00 acct=a",
+		// Both buys could execute.
+		"limit buy 8 99.00 acct=a",
+		"market sell 16 0.00",
+		// Executed units count once, in the position.
+		"limit buy 2 98.00 acct=a",
+		"limit buy 1 98.00 acct=a",
+		// Reducing an order frees its units.
+		"modify na 4 98.00 1",
+		"limit buy 1 97.00 acct=a",
+		// Buys don't count against sells.
+		"limit sell 18 110.00 acct=a",
+		"limit sell 1 110.00 acct=a",
+	}, "\n")
+	want := strings.Join([]string{
+		"reject 2 position 16 exceeds limit 10",
+		"match 3 1 8 99.00",
+		"reject 5 position 11 exceeds limit 10",
+		"reject 9 position -11 exceeds limit 10",
+	}, "\n") + "\n"
+	w := &bytes.Buffer{}
+	if err := run(ex, strings.NewReader(in), w, &bytes.Buffer{}, true); err != nil {
+		t.Fatalf("run() got error %v", err)
+	}
+	if got := w.String(); got != want {
+		t.Errorf("got output (-want +got):\n%s", diffLines(got, want))
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+type (
+	// Level is the aggregated orders at one price of a book.
+	Level struct {
+		// Price is the price of the level, which is the threshold for
+		// stop orders.
+		Price Price `json:"price"`
+		// Volume is the number of units displayed at the level, which
+		// leaves out the hidden units of iceberg orders.
+		Volume Volume `json:"volume"`
+		// Orders is the number of orders at the level.
+		Orders int `json:"orders"`
+	}
+
+	// Snapshot is the aggregated depth of an OrderBook at some point.
+	Snapshot struct {
+		Symbol string `json:"symbol"`
+		// Bids holds the BuySide levels, best (highest) price first.
+		Bids []Level `json:"bids"`
+		// Asks holds the SellSide levels, best (lowest) price first.
+		Asks []Level `json:"asks"`
+		// BuyStops holds the levels of untriggered BuySide stop orders,
+		// lowest threshold, i.e. next to trigger, first.
+		BuyStops []Level `json:"buy_stops"`
+		// SellStops holds the levels of untriggered SellSide stop orders,
+		// highest threshold, i.e. next to trigger, first.
+		SellStops []Level `json:"sell_stops"`
+	}
+
+	// level3Order is a resting Order in a level-3 snapshot.
+	level3Order struct {
+		ID        OrderNumber `json:"id"`
+		Type      string      `json:"type"`
+		Volume    Volume      `json:"volume"`
+		Remaining Volume      `json:"remaining"`
+		// Displayed is less than Remaining for iceberg orders.
+		Displayed Volume `json:"displayed"`
+		// Limit is set for untriggered StopLimit orders, which are kept at
+		// their threshold.
+		Limit *Price `json:"limit,omitempty"`
+	}
+
+	// level3Level is the resting orders at one price in a level-3
+	// snapshot, oldest first.
+	level3Level struct {
+		Price  Price         `json:"price"`
+		Orders []level3Order `json:"orders"`
+	}
+
+	// level3Book is a level-3 snapshot of an OrderBook, holding every
+	// resting order.
+	level3Book struct {
+		Symbol    string        `json:"symbol"`
+		Bids      []level3Level `json:"bids"`
+		Asks      []level3Level `json:"asks"`
+		BuyStops  []level3Level `json:"buy_stops"`
+		SellStops []level3Level `json:"sell_stops"`
+	}
+)
+
+// MarshalJSON returns the Price as a JSON string such as "99.50", so
+// that it is represented exactly.
+func (p Price) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+// UnmarshalJSON sets the Price from a JSON string such as "99.50".
+func (p *Price) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	price, err := ParsePrice(s)
+	if err != nil {
+		return fmt.Errorf("invalid price %q: %w", s, err)
+	}
+	*p = price
+	return nil
+}
+
+// levels calls fn for each level of s, in the order given by walk.
+func levels(walk func(func(*priceLevel) bool), fn func(*priceLevel)) {
+	walk(func(level *priceLevel) bool {
+		fn(level)
+		return true
+	})
+}
+
+// depth returns the aggregated levels given by walk.
+func depth(walk func(func(*priceLevel) bool)) []Level {
+	result := []Level{}
+	levels(walk, func(level *priceLevel) {
+		result = append(result, Level{level.price, level.volume(), level.orders.Len()})
+	})
+	return result
+}
+
+// level3 returns the orders in the levels given by walk.
+func level3(walk func(func(*priceLevel) bool)) []level3Level {
+	result := []level3Level{}
+	levels(walk, func(level *priceLevel) {
+		l := level3Level{Price: level.price, Orders: []level3Order{}}
+		level.each(func(order *Order) bool {
+			o := level3Order{
+				ID:        order.id,
+				Type:      order.Type.String(),
+				Volume:    order.Volume,
+				Remaining: order.Remaining,
+				Displayed: order.Displayed(),
+			}
+			if order.Type == StopLimit && !order.stopTriggered {
+				limit := order.Limit
+				o.Limit = &limit
+			}
+			l.Orders = append(l.Orders, o)
+			return true
+		})
+		result = append(result, l)
+	})
+	return result
+}
+
+// Snapshot returns the aggregated depth of all levels in the book.
+func (book *OrderBook) Snapshot() Snapshot {
+	return Snapshot{
+		Symbol:    book.symbol,
+		Bids:      depth(book.buyOrders.each),
+		Asks:      depth(book.sellOrders.each),
+		BuyStops:  depth(book.buyStops.levels.ascend),
+		SellStops: depth(book.sellStops.levels.descend),
+	}
+}
+
+// WriteLevel3 writes every order resting in the book to w as JSON,
+// grouped by level in priority order.
+func (book *OrderBook) WriteLevel3(w io.Writer) error {
+	return json.NewEncoder(w).Encode(book.level3())
+}
+
+// level3 returns a level-3 snapshot of the book.
+func (book *OrderBook) level3() level3Book {
+	return level3Book{
+		Symbol:    book.symbol,
+		Bids:      level3(book.buyOrders.each),
+		Asks:      level3(book.sellOrders.each),
+		BuyStops:  level3(book.buyStops.levels.ascend),
+		SellStops: level3(book.sellStops.levels.descend),
+	}
+}
+
+// WriteLevel3 writes a level-3 snapshot of each book in the Exchange to
+// w as a JSON array, ordered by symbol.
+func (ex *Exchange) WriteLevel3(w io.Writer) error {
+	books := []level3Book{}
+	for _, symbol := range ex.Symbols() {
+		books = append(books, ex.books[symbol].level3())
+	}
+	return json.NewEncoder(w).Encode(books)
+}
+
+// writeDepth writes the best n bid and ask levels of the book to w, as
+// lines like "depth bid 99.50 15 2", where the values are the price,
+// displayed volume and number of orders at the level.
+//
+// The Symbol of the book is appended, unless it is the default
+// instrument.
+func (book *OrderBook) writeDepth(w io.Writer, n int) {
+	snap := book.Snapshot()
+	suffix := ""
+	if book.symbol != "" {
+		suffix = " " + book.symbol
+	}
+	for _, side := range []struct {
+		name   string
+		levels []Level
+	}{{"bid", snap.Bids}, {"ask", snap.Asks}} {
+		for i, l := range side.levels {
+			if i == n {
+				break
+			}
+			fmt.Fprintf(w, "depth %s %v %v %v%s\n", side.name, l.Price, l.Volume, l.Orders, suffix)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestOrderBook_Snapshot(t *testing.T) {
+	book := newOrderBook()
+	addAll(&book,
+		"limit buy 10 99.00",
+		"limit buy 5 99.00",
+		"limit buy 7 98.50",
+		"limit sell 4 100.00",
+		"limit sell 6 101.00",
+		"limit sell 3 99.00",
+		"stop buy 2 102.00",
+		"stop buy 2 101.50",
+		"stoplimit sell 1 97.00 96.00",
+	)
+
+	got := book.Snapshot()
+	want := Snapshot{
+		Bids:      []Level{{9900, 12, 2}, {9850, 7, 1}},
+		Asks:      []Level{{10000, 4, 1}, {10100, 6, 1}},
+		BuyStops:  []Level{{10150, 2, 1}, {10200, 2, 1}},
+		SellStops: []Level{{9700, 1, 1}},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got snapshot %+v; want %+v", got, want)
+	}
+}
+
+func TestExchange_WriteLevel3(t *testing.T) {
+	ex := newExchange()
+	in := strings.Join([]string{
+		"limit buy 10 99.00 sym=MSFT",
+		"limit sell 4 98.00 sym=MSFT",
+		"limit buy 3 99.00 sym=MSFT",
+		"stoplimit sell 1 97.00 96.00 sym=MSFT",
+		"limit sell 2 100.50",
+	}, "\n")
+	if err := run(ex, strings.NewReader(in), &bytes.Buffer{}, &bytes.Buffer{}, true); err != nil {
+		t.Fatalf("run() got error %v", err)
+	}
+
+	w := &bytes.Buffer{}
+	if err := ex.WriteLevel3(w); err != nil {
+		t.Fatalf("WriteLevel3() got error %v", err)
+	}
+	books := []level3Book{}
+	if err := json.Unmarshal(w.Bytes(), &books); err != nil {
+		t.Fatalf("got invalid JSON %q: %v", w, err)
+	}
+	if len(books) != 2 || books[0].Symbol != "" || books[1].Symbol != "MSFT" {
+		t.Fatalf("got books %+v; want default book and MSFT", books)
+	}
+	if got, want := books[0].Asks[0].Price, Price(10050); got != want {
+		t.Errorf("got ask price %v; want %v", got, want)
+	}
+	msft := books[1]
+	if len(msft.Bids) != 1 || len(msft.Bids[0].Orders) != 2 {
+		t.Fatalf("got MSFT bids %+v; want one level with two orders", msft.Bids)
+	}
+	if got := msft.Bids[0].Orders[0]; got.ID != 1 || got.Volume != 10 || got.Remaining != 6 {
+		t.Errorf("got first bid %+v; want order 1 with 6 of 10 remaining", got)
+	}
+	if got := msft.Bids[0].Orders[1].ID; got != 3 {
+		t.Errorf("got second bid %d; want 3", got)
+	}
+	stop := msft.SellStops[0].Orders[0]
+	if stop.Limit == nil || *stop.Limit != 9600 {
+		t.Errorf("got stop-limit %+v; want limit 96.00", stop)
+	}
+	if !strings.Contains(w.String(), `"price":"99.00"`) {
+		t.Errorf("got %q; want prices as decimal strings", w)
+	}
+}
+
+func TestRun_depth(t *testing.T) {
+	in := strings.Join([]string{
+		"limit buy 10 99.00",
+		"limit buy 5 99.00",
+		"limit buy 7 98.50",
+		"limit sell 4 100.00",
+		"limit sell 1 99.50 sym=AAPL",
+		"depth 1",
+		"depth 5 sym=AAPL",
+		"depth 1 sym=MSFT",
+		"depth x",
+	}, "\n")
+
+	w, errw := &bytes.Buffer{}, &bytes.Buffer{}
+	if err := run(newExchange(), strings.NewReader(in), w, errw, false); err != nil {
+		t.Fatalf("run() got error %v; want nil", err)
+	}
+	want := strings.Join([]string{
+		"depth bid 99.00 15 2",
+		"depth ask 100.00 4 1",
+		"depth ask 99.50 1 1 AAPL",
+		"",
+	}, "\n")
+	if got := w.String(); got != want {
+		t.Errorf("got output %q; want %q", got, want)
+	}
+	if !strings.Contains(errw.String(), "line 9: ") {
+		t.Errorf("got errors %q; want line 9 to be rejected", errw)
+	}
+
+	err := run(newExchange(), strings.NewReader(in), &bytes.Buffer{}, &bytes.Buffer{}, true)
+	if !errors.Is(err, ErrCommand) || !strings.HasPrefix(err.Error(), "line 9: ") {
+		t.Errorf("run() in strict mode got error %v; want line 9 to fail with %v", err, ErrCommand)
+	}
+}
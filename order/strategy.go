@@ -0,0 +1,91 @@
+package main
+
+import "fmt"
+
+type (
+	// Momentum is a Strategy that buys after a trade at a higher price
+	// than the last one, and sells after a trade at a lower price, with
+	// Market orders for Volume units. It only adds to a position when it
+	// is flat.
+	Momentum struct {
+		Volume Volume
+		// last holds the price of the last trade of each symbol.
+		last map[string]Price
+	}
+
+	// Maker is a Strategy that quotes Volume units on both sides of the
+	// book for Symbol, joining the best bid and offer whenever they move.
+	Maker struct {
+		Volume Volume
+		Symbol string
+		// quotes holds the BuySide and SellSide orders of the Maker.
+		quotes [2]*Order
+	}
+)
+
+// symbolOption returns the option for orders in symbol, or "" for the
+// default instrument.
+func symbolOption(symbol string) string {
+	if symbol == "" {
+		return ""
+	}
+	return " sym=" + symbol
+}
+
+// OnMarketData trades in the direction of the last price change.
+func (m *Momentum) OnMarketData(b *Broker, event MarketEvent) {
+	t, ok := event.(Trade)
+	if !ok {
+		return
+	}
+	if m.last == nil {
+		m.last = map[string]Price{}
+	}
+	prev, seen := m.last[t.Symbol]
+	m.last[t.Symbol] = t.Price
+	if !seen || b.Pending() > 0 {
+		return
+	}
+	pos := b.Position(t.Symbol)
+	side := BuySide
+	switch {
+	case t.Price > prev && pos <= 0:
+	case t.Price < prev && pos >= 0:
+		side = SellSide
+	default:
+		return
+	}
+	b.Submit(fmt.Sprintf("market %v %v 0.00%s", side, m.Volume, symbolOption(t.Symbol)))
+}
+
+// OnFill does nothing, since the position is looked up when needed.
+func (m *Momentum) OnFill(b *Broker, fill Fill) {}
+
+// OnMarketData moves the quotes of the Maker to the best bid and offer.
+func (m *Maker) OnMarketData(b *Broker, event MarketEvent) {
+	q, ok := event.(Quote)
+	if !ok || q.Symbol != m.Symbol || b.Pending() > 0 {
+		return
+	}
+	for i, best := range []struct {
+		side   OrderSide
+		price  Price
+		volume Volume
+	}{{BuySide, q.Bid, q.BidVolume}, {SellSide, q.Ask, q.AskVolume}} {
+		if best.volume == 0 {
+			continue
+		}
+		order := m.quotes[i]
+		open := order != nil && !order.executed && !order.cancelled
+		if open && order.Limit == best.price {
+			continue
+		}
+		if open {
+			b.Cancel(order)
+		}
+		m.quotes[i], _ = b.Submit(fmt.Sprintf("limit %v %v %v%s", best.side, m.Volume, best.price, symbolOption(m.Symbol)))
+	}
+}
+
+// OnFill does nothing, since a new quote is placed once the book moves.
+func (m *Maker) OnFill(b *Broker, fill Fill) {}